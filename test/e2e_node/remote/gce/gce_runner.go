@@ -18,30 +18,49 @@ package gce
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"k8s.io/kubernetes/test/e2e_node/remote"
 
+	"cloud.google.com/go/storage"
 	"github.com/google/uuid"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
 	"google.golang.org/api/option"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 	"sigs.k8s.io/yaml"
 )
 
 var _ remote.Runner = (*GCERunner)(nil)
+var _ remote.HostLister = (*GCERunner)(nil)
 
 func init() {
 	remote.RegisterRunner("gce", NewGCERunner)
@@ -70,26 +89,212 @@ func (e *envs) Set(value string) error {
 // nodeEnvs is the node envs from the flag `node-env`.
 var nodeEnvs = make(envs)
 
+// nodeAffinityFlags collects repeated `node-affinity` key=value pairs as
+// sole-tenant node affinities with operator IN.
+type nodeAffinityFlags []*compute.SchedulingNodeAffinity
+
+// String function of flag.Value
+func (n *nodeAffinityFlags) String() string {
+	return fmt.Sprint(*n)
+}
+
+// Set function of flag.Value
+func (n *nodeAffinityFlags) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("invalid node affinity %q, expected key=value", value)
+	}
+	*n = append(*n, &compute.SchedulingNodeAffinity{
+		Key:      kv[0],
+		Operator: "IN",
+		Values:   []string{kv[1]},
+	})
+	return nil
+}
+
+// nodeAffinities is the sole-tenant node affinities from the flag
+// `node-affinity`.
+var nodeAffinities nodeAffinityFlags
+
 var project = flag.String("project", "", "gce project the hosts live in (gce)")
 var zone = flag.String("zone", "", "gce zone that the hosts live in (gce)")
+var zones = flag.String("zones", "", "comma-separated list of gce zones to distribute instances across round-robin. Takes precedence over --zone (gce)")
 var instanceMetadata = flag.String("instance-metadata", "", "key/value metadata for instances separated by '=' or '<', 'k=v' means the key is 'k' and the value is 'v'; 'k<p' means the key is 'k' and the value is extracted from the local path 'p', e.g. k1=v1,k2<p2  (gce)")
+var strictMetadata = flag.Bool("strict-metadata", false, "If true, fail on duplicate instance metadata keys instead of logging a warning.  (gce)")
+var preflightScript = flag.String("preflight-script", "", "Path to a script run on each instance via SSH after provisioning; a non-zero exit fails the image before the suite starts  (gce)")
+var collectJournal = flag.Bool("collect-journal", false, "If true, fetch the journald log from each instance after the suite runs and store it as journal.log in the artifacts  (gce)")
+var streamSerial = flag.Bool("stream-serial", false, "If true, stream serial console output to stderr while instances provision  (gce)")
+var keepOnFailure = flag.Bool("keep-on-failure", false, "If true, keep instances whose test suite failed for debugging while still deleting the passing ones  (gce)")
+var buildID = flag.String("build-id", "", "CI build/job identifier attached to instances as both a label and a metadata item; defaults to PROW_JOB_ID or BUILD_ID  (gce)")
+var instanceNameSuffix = flag.String("instance-name-suffix", "", "Suffix appended to generated instance names, so concurrent jobs targeting the same image produce distinct instances  (gce)")
+var metricsListenAddr = flag.String("metrics-listen-addr", "", "Address to serve Prometheus metrics on while the runner is active, e.g. :9100. Empty disables the metrics server  (gce)")
+var onHostMaintenance = flag.String("on-host-maintenance", "", "OnHostMaintenance policy for instances, one of MIGRATE|TERMINATE. Empty uses the GCE default; accelerators and Confidential VM always force TERMINATE  (gce)")
+var automaticRestart = flag.String("automatic-restart", "", "Whether instances restart automatically after maintenance events, one of true|false. Empty uses the GCE default; ignored on preemptible instances, which cannot restart automatically  (gce)")
+var deletionProtection = flag.Bool("deletion-protection", false, "If true, create instances with GCE deletion protection, so sweepers and errant cleanups cannot remove them. The runner clears the protection before deleting its own instances  (gce)")
+var listImages = flag.Bool("list-images", false, "If true, print the concrete image each configured short-name resolves to and exit without creating anything  (gce)")
 var imageProject = flag.String("image-project", "", "gce project the hosts live in  (gce)")
 var instanceType = flag.String("instance-type", "e2-medium", "GCP Machine type to use for test")
 var preemptibleInstances = flag.Bool("preemptible-instances", false, "If true, gce instances will be configured to be preemptible  (gce)")
+var bootDiskDeviceName = flag.String("boot-disk-device-name", "", "Device name to assign to the boot disk. If empty, GCE generates one  (gce)")
+var instanceUpTimeout = flag.Duration("instance-up-timeout", 10*time.Minute, "how long to wait for an instance to reach RUNNING state with a running runtime daemon  (gce)")
+var sshTimeout = flag.Duration("ssh-timeout", 45*time.Second, "bound on each SSH attempt of the instance readiness daemon check  (gce)")
+var runtimeServiceName = flag.String("runtime-service-name", "containerd,crio", "Comma-separated systemd service names the instance readiness daemon check accepts, e.g. youki for alternative runtimes  (gce)")
+var skipRuntimeCheck = flag.Bool("skip-runtime-check", false, "Skip the runtime daemon readiness check and proceed once SSH is reachable, for images that don't run a runtime service at boot  (gce)")
+var cloudInitTimeout = flag.Duration("cloud-init-timeout", 20*time.Minute, "how long to wait for cloud-init to finish on an instance  (gce)")
+var computeClientRetries = flag.Int("compute-client-retries", 10, "how often to retry creating the gce compute client before giving up  (gce)")
+var computeClientBackoff = flag.Duration("compute-client-backoff", 6*time.Second, "initial backoff between attempts to create the gce compute client, doubled on every retry  (gce)")
+var injectReadinessScript = flag.Bool("inject-readiness-script", false, "If true, inject a startup-script that signals startup completion via the startup/status guest attribute, and poll that attribute instead of checking cloud-init over SSH  (gce)")
+var serviceAccount = flag.String("service-account", "", "Service account email to run instances as. If empty, the project default service account is used  (gce)")
+var serviceAccountScopes = flag.String("service-account-scopes", "", "Comma-separated OAuth scopes granted to the instance service account. Required when --service-account is set  (gce)")
+var broadScopes = flag.Bool("broad-scopes", false, "If true, grant instances the broad cloud-platform scope instead of the default minimal scope set (logging write, monitoring write, storage read-only)  (gce)")
+var gcpCredentialsFile = flag.String("gcp-credentials-file", "", "Path to a service account JSON key file to authenticate the compute client with. If empty, application default credentials are used  (gce)")
+var impersonateServiceAccount = flag.String("impersonate-service-account", "", "Service account email to impersonate for compute API calls, e.g. with workload identity federation. Uses --gcp-credentials-file as source credentials when set  (gce)")
+var networkTier1 = flag.Bool("network-tier1", false, "If true, enable TIER_1 total egress bandwidth on instances. Only supported on selected machine families  (gce)")
+var enableSerialConsole = flag.Bool("enable-serial-console", false, "If true, enable interactive serial-console access to instances via the serial-port-enable metadata  (gce)")
+var enableOpsAgent = flag.Bool("enable-ops-agent", false, "If true, enable the built-in Cloud Logging and Monitoring agents on instances via the google-logging-enabled/google-monitoring-enabled metadata  (gce)")
+var zoneOperationRetries = flag.Int("zone-operation-retries", 4, "how often to retry transient ZoneOperations.Get errors within a single provisioning poll iteration  (gce)")
+var resultsGCSBucket = flag.String("results-gcs-bucket", "", "GCS bucket to upload serial logs and junit files to after each image finished, under <instance-name-prefix>/<image>/. Uploads are best-effort  (gce)")
+var cleanupNamePrefix = flag.String("cleanup-name-prefix", "", "Name prefix of orphaned instances from earlier runs to delete before starting tests. Must be combined with --cleanup-label-selector; only instances matching both are deleted  (gce)")
+var provisionWorkers = flag.Int("provision-workers", 0, "Number of worker goroutines provisioning and testing images concurrently. 0 runs every image in its own worker  (gce)")
+var cleanupOrphansOnStart = flag.Bool("cleanup-orphans-on-start", false, "If true, delete instances left by a crashed earlier run with the exact same instance-name-prefix before creating anything. Narrower than the --cleanup-name-prefix sweep  (gce)")
+var cleanupLabelSelector = flag.String("cleanup-label-selector", "", "Comma-separated k=v labels orphaned instances must all carry to be deleted by --cleanup-name-prefix  (gce)")
+var diskLabels = flag.String("disk-labels", "", "Comma-separated k=v labels applied to the boot disk, so cost tools can attribute disk spend separately from instance spend. Defaults to the instance labels  (gce)")
+var measureBootTime = flag.Bool("measure-boot-time", false, "If true, measure the time from instance insert completion to SSH readiness and record it as a boot-time metric on the test result  (gce)")
+var allowedZones = flag.String("allowed-zones", "", "Comma-separated allowlist of zones instances may be created in. Any --zone/--zones value outside it is rejected before provisioning. Empty means unrestricted  (gce)")
+var confidentialCompute = flag.Bool("confidential-compute", false, "If true, create Confidential VM instances. Only supported on selected machine families, and forces on-host-maintenance TERMINATE  (gce)")
+var installGPUDrivers = flag.Bool("install-gpu-drivers", false, "If true, install GPU drivers on instances with accelerators attached after boot and verify nvidia-smi succeeds before running tests  (gce)")
+var provisionOnly = flag.Bool("provision-only", false, "If true, create all instances, record them to --instance-state-file and exit without running tests or deleting instances  (gce)")
+var testFromState = flag.Bool("test-from-state", false, "If true, skip provisioning and run tests against the instances recorded in --instance-state-file by an earlier --provision-only run  (gce)")
+var instanceStateFile = flag.String("instance-state-file", "", "Path of the state file written by --provision-only and read by --test-from-state  (gce)")
+var allowDeprecatedImages = flag.Bool("allow-deprecated-images", false, "If true, image regex/family resolution may also pick images marked DEPRECATED, OBSOLETE or DELETED  (gce)")
+var fileInjectManifest = flag.String("file-inject", "", "Path to a yaml manifest listing local/remote file pairs to copy onto each node after readiness and before the suite runs  (gce)")
+var sampleNodeResources = flag.Bool("sample-node-resources", false, "If true, sample node-level CPU load and memory usage while the suite runs and attach a summary to the test result  (gce)")
+var collectInstanceDescribe = flag.Bool("collect-instance-describe", false, "If true, write the effective instance metadata to instance-metadata.json in the artifacts after provisioning, with secret-looking keys redacted  (gce)")
+var dryRun = flag.Bool("dry-run", false, "If true, print the instance specs that would be submitted and report the tests as skipped instead of calling Instances.Insert  (gce)")
+var initialReadinessDelay = flag.Duration("initial-readiness-delay", 30*time.Second, "how long to wait after an instance reached RUNNING before the first SSH readiness attempt, since sshd needs a moment to come up  (gce)")
+var reuseInstances = flag.Bool("reuse-instances", false, "If true, run against an already-RUNNING instance with the expected name instead of creating one, and keep it afterwards. Speeds up repeated debugging on the same node  (gce)")
+var enableGvnic = flag.Bool("enable-gvnic", false, "If true, use GVNIC instead of VirtIO networking on instances whose image supports it  (gce)")
+var stackType = flag.String("stack-type", stackTypeIPv4Only, fmt.Sprintf("network stack type for instances, one of %s|%s. %s requires a dual-stack subnetwork  (gce)", stackTypeIPv4Only, stackTypeDualStack, stackTypeDualStack))
+var enableNestedVirtualization = flag.Bool("enable-nested-virtualization", false, "If true, enable nested virtualization on instances. Requires a Haswell or newer Intel CPU platform, see --min-cpu-platform  (gce)")
+var minCPUPlatform = flag.String("min-cpu-platform", "", "minimum CPU platform for instances, e.g. 'Intel Haswell'  (gce)")
+var threadsPerCore = flag.Int("threads-per-core", 0, "number of threads per physical core on instances, 1 disables SMT. 0 keeps the machine-type default  (gce)")
+var visibleCoreCount = flag.Int("visible-core-count", 0, "number of physical cores to expose to instances. 0 keeps the machine-type default  (gce)")
+var reservationAffinity = flag.String("reservation-affinity", "", "reservation to consume capacity from, one of 'any', 'none' or 'specific:<name>'. Empty keeps the project default  (gce)")
+var regionalDisk = flag.Bool("regional-disk", false, "If true, back the boot disk with a regional PD replicated across two zones of the instance's region  (gce)")
+var waitForDelete = flag.Bool("wait-for-delete", false, "If true, wait for instance delete operations to finish instead of returning immediately, e.g. to avoid quota collisions with a directly following run  (gce)")
+var apiRetries = flag.Int("api-retries", 3, "how often to attempt transient-failing compute API calls (HTTP 500/502/503, rate limits) before giving up. Permanent 4xx errors are never retried  (gce)")
+var useOSLogin = flag.Bool("use-os-login", false, "If true, enable OS Login on instances instead of metadata SSH keys. The connecting identity needs roles/compute.osLogin (or osAdminLogin) and, for instances running as a service account, roles/iam.serviceAccountUser  (gce)")
+var osLoginEmail = flag.String("os-login-email", "", "email of the OS Login identity connecting to instances, used to derive the managed username (<user>_<domain>). Service accounts map to sa_<id>, pass that via --ssh-user instead  (gce)")
 
 func init() {
 	flag.Var(&nodeEnvs, "node-env", "An environment variable passed to instance as metadata, e.g. when '--node-env=PATH=/usr/bin' is specified, there will be an extra instance metadata 'PATH=/usr/bin'.")
+	flag.Var(&nodeAffinities, "node-affinity", "A sole-tenant node affinity in 'key=value' form, e.g. 'workload=licensed'. May be repeated; instances are scheduled onto node groups matching all affinities  (gce)")
 }
 
 const (
 	defaultGCEMachine             = "n1-standard-1"
 	acceleratorTypeResourceFormat = "https://www.googleapis.com/compute/v1/projects/%s/zones/%s/acceleratorTypes/%s"
+	// localSSDSizeGb is the fixed size of a GCE local SSD partition.
+	localSSDSizeGb = 375
+	// maxLocalSSDCount is the maximum number of local SSDs attachable to any
+	// GCE machine type.
+	maxLocalSSDCount = 24
+	// provisionPollInterval is how often instance provisioning state is polled.
+	provisionPollInterval = 20 * time.Second
+	// shutdownGracePeriod bounds the best-effort instance deletion on
+	// SIGINT/SIGTERM, so a hung API cannot block shutdown forever.
+	shutdownGracePeriod = 2 * time.Minute
+	// deletePollInterval and deleteTimeout bound the wait for delete
+	// operations with --wait-for-delete. Deletions finish quickly, so they
+	// are polled more tightly than provisioning.
+	deletePollInterval = time.Second
+	deleteTimeout      = 5 * time.Minute
+
+	// readinessAttributePath is the guest attribute written by the injected
+	// readiness startup-script once startup completed.
+	readinessAttributePath = "startup/status"
+	// readinessAttributeDone is the value signaling startup completion.
+	readinessAttributeDone = "done"
+
+	// defaultGPUDriverVersion is the GPU driver version installed when the
+	// image config does not pin one.
+	defaultGPUDriverVersion = "latest"
+
+	// stackTypeIPv4Only and stackTypeDualStack are the supported
+	// --stack-type values.
+	stackTypeIPv4Only  = "IPV4_ONLY"
+	stackTypeDualStack = "IPV4_IPV6"
 )
 
+// readinessStartupScript writes the startup/status guest attribute once the
+// startup sequence completed. Startup-scripts run after cloud-init/startup
+// finished, so polling the attribute replaces the SSH-based cloud-init check.
+const readinessStartupScript = `#!/bin/bash
+curl -s -X PUT --data "` + readinessAttributeDone + `" -H "Metadata-Flavor: Google" "http://metadata.google.internal/computeMetadata/v1/instance/guest-attributes/` + readinessAttributePath + `"
+`
+
 type GCERunner struct {
 	cfg               remote.Config
 	gceComputeService *compute.Service
 	gceImages         *internalGCEImageConfig
+
+	// zoneMu guards nextZoneIndex and hostZones, as instances are created
+	// concurrently.
+	zoneMu        sync.Mutex
+	nextZoneIndex int
+	// hostZones maps an instance name to the zone it was created in, so that
+	// per-host operations (delete, serial log, IP registration) target the
+	// right zone even when it differs from the global --zone.
+	hostZones map[string]string
+	// hostProjects maps an instance name to the project it was launched into,
+	// so per-host operations target the right project when an image's
+	// launch_project differs from the global --project.
+	hostProjects map[string]string
+	// reusedInstances records instances that pre-existed and were adopted via
+	// --reuse-instances, which must not be deleted after the run.
+	reusedInstances map[string]bool
+	// keptHosts records instances that must outlive the run: images with
+	// delete_instance=false and hosts kept by --keep-on-failure. Shutdown
+	// cleanup skips them, like it skips reused instances.
+	keptHosts map[string]bool
+
+	// clock is used for boot-time measurements and can be faked in tests. A
+	// nil clock falls back to the real clock.
+	clock clock.PassiveClock
+	// bootStarts maps an instance name to the time its insert operation was
+	// first observed DONE, i.e. the start of the boot phase.
+	bootStarts map[string]time.Time
+	// hostBootTimes maps an instance name to the measured duration from insert
+	// completion to SSH readiness.
+	hostBootTimes map[string]time.Duration
+
+	// stateMu guards provisioned, the instances recorded to the state file in
+	// --provision-only mode.
+	stateMu     sync.Mutex
+	provisioned []provisionedInstance
+
+	// resolvedImages caches regex/family image resolution so config entries
+	// sharing the same lookup don't repeat the paged Images.List call.
+	resolvedImages map[string]string
+
+	// timelineMu guards timeline, the per-host event log exported as
+	// timeline.json for post-mortem analysis.
+	timelineMu sync.Mutex
+	timeline   []timelineEvent
+
+	// pollCtx is the context used by provisioning polls, cancelled by the
+	// shutdown signal handler so in-flight provisioning aborts promptly. A nil
+	// pollCtx falls back to the background context.
+	pollCtx    context.Context
+	pollCancel context.CancelFunc
+}
+
+// timelineEvent is one entry of the exported run timeline, e.g. an instance
+// reaching RUNNING or a test suite starting.
+type timelineEvent struct {
+	Host  string    `json:"host"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
 }
 
 func NewGCERunner(cfg remote.Config) remote.Runner {
@@ -100,70 +305,322 @@ func NewGCERunner(cfg remote.Config) remote.Runner {
 }
 
 func (g *GCERunner) Validate() error {
-	if len(g.cfg.Hosts) == 0 && g.cfg.ImageConfigFile == "" && len(g.cfg.Images) == 0 {
-		klog.Fatalf("Must specify one of --image-config-file, --hosts, --images.")
+	if len(g.cfg.Hosts) == 0 && g.cfg.ImageConfigFile == "" && len(g.cfg.Images) == 0 && !*testFromState {
+		return errors.New("must specify one of --image-config-file, --hosts, --images")
+	}
+	// When the runner itself runs on a GCE VM, default unset --project/--zone
+	// from the metadata server before they are validated below.
+	defaultProjectAndZoneFromMetadata()
+	if *provisionOnly && *testFromState {
+		return errors.New("--provision-only and --test-from-state are mutually exclusive")
+	}
+	if (*provisionOnly || *testFromState) && *instanceStateFile == "" {
+		return errors.New("must specify --instance-state-file with --provision-only or --test-from-state")
+	}
+	if *serviceAccount != "" && *serviceAccountScopes == "" {
+		return errors.New("must specify --service-account-scopes when --service-account is set")
+	}
+	// Require both cleanup filters so a broad org-wide name prefix alone can
+	// never wipe instances belonging to other jobs.
+	if (*cleanupNamePrefix == "") != (*cleanupLabelSelector == "") {
+		return errors.New("--cleanup-name-prefix and --cleanup-label-selector must be set together")
+	}
+	if *stackType != stackTypeIPv4Only && *stackType != stackTypeDualStack {
+		return fmt.Errorf("invalid --stack-type %q, must be one of %s|%s", *stackType, stackTypeIPv4Only, stackTypeDualStack)
+	}
+	if *threadsPerCore < 0 || *visibleCoreCount < 0 {
+		return errors.New("--threads-per-core and --visible-core-count must be positive")
+	}
+	if *onHostMaintenance != "" && *onHostMaintenance != "MIGRATE" && *onHostMaintenance != "TERMINATE" {
+		return fmt.Errorf("invalid --on-host-maintenance %q, must be one of MIGRATE|TERMINATE", *onHostMaintenance)
+	}
+	if *automaticRestart != "" && *automaticRestart != "true" && *automaticRestart != "false" {
+		return fmt.Errorf("invalid --automatic-restart %q, must be one of true|false", *automaticRestart)
+	}
+	// Catch typos in custom machine types here instead of as an opaque
+	// insert failure ten minutes in.
+	if err := validateCustomMachineType(*instanceType); err != nil {
+		return err
+	}
+	// Reject malformed reservation affinities before provisioning anything.
+	if _, err := parseReservationAffinity(*reservationAffinity); err != nil {
+		return err
+	}
+	if _, err := bootDiskLabels(nil); err != nil {
+		return err
+	}
+	// Regional boot disks need a derivable second replica zone in every
+	// configured zone's region.
+	if *regionalDisk {
+		for _, z := range g.testZones() {
+			if _, err := replicaZonesForZone(z); err != nil {
+				return err
+			}
+		}
+	}
+	// Reject zones outside the allowlist before provisioning anything, e.g.
+	// to keep instances out of expensive or disallowed regions.
+	if err := validateAllowedZones(); err != nil {
+		return err
+	}
+	// Fail before provisioning (potentially expensive) instances that we
+	// would not be able to reach anyway.
+	if err := validateSSHKeys(); err != nil {
+		return err
+	}
+	// Likewise fail early when injected files are missing.
+	if *fileInjectManifest != "" {
+		injections, err := parseFileInjectManifest(*fileInjectManifest)
+		if err != nil {
+			return err
+		}
+		for _, fi := range injections {
+			if _, err := os.Stat(fi.Local); err != nil {
+				return fmt.Errorf("file-inject local file %q is not readable: %w", fi.Local, err)
+			}
+		}
 	}
 	var err error
-	g.gceComputeService, err = getComputeClient()
+	g.gceComputeService, err = getComputeClient(defaultComputeServiceFactory)
 	if err != nil {
 		return fmt.Errorf("Unable to create gcloud compute service using defaults.  Make sure you are authenticated. %w", err)
 	}
 
 	if g.gceImages, err = g.prepareGceImages(); err != nil {
-		klog.Fatalf("While preparing GCE images: %v", err)
+		return fmt.Errorf("while preparing GCE images: %w", err)
+	}
+	if *listImages {
+		g.printResolvedImages(os.Stdout)
+		os.Exit(0)
 	}
 	return nil
 }
 
+// printResolvedImages writes the short-name to image resolution table for the
+// prepared image config, a read-only preview of what a run would create.
+func (g *GCERunner) printResolvedImages(w io.Writer) {
+	names := make([]string, 0, len(g.gceImages.images))
+	for name := range g.gceImages.images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		img := g.gceImages.images[name]
+		machine := img.machine
+		if machine == "" {
+			machine = defaultGCEMachine
+		}
+		fmt.Fprintf(tw, "%s\t%s/%s\t(%s)\n", name, img.project, img.image, machine)
+	}
+	tw.Flush()
+}
+
 func (g *GCERunner) StartTests(suite remote.TestSuite, archivePath string, results chan *remote.TestResult) (numTests int) {
+	g.pollCtx, g.pollCancel = context.WithCancel(context.Background())
+	g.handleShutdownSignals()
+	if *metricsListenAddr != "" {
+		g.startMetricsServer(*metricsListenAddr)
+	}
+	if *cleanupNamePrefix != "" {
+		if err := g.deleteOrphanInstances(); err != nil {
+			klog.Warningf("Failed to delete orphaned instances: %v", err)
+		}
+	}
+	if *cleanupOrphansOnStart {
+		if err := g.deleteOwnPrefixInstances(); err != nil {
+			klog.Warningf("Failed to delete instances with prefix %q: %v", g.cfg.InstanceNamePrefix, err)
+		}
+	}
+	if *testFromState {
+		state, err := readProvisionState(*instanceStateFile)
+		if err != nil {
+			klog.Fatalf("Failed to read instance state file %q: %v", *instanceStateFile, err)
+		}
+		for _, instance := range state.Instances {
+			numTests++
+			fmt.Printf("Initializing e2e tests on provisioned instance %s using image %s.\n", instance.Host, instance.Image)
+			go func(instance provisionedInstance) {
+				results <- g.runStateJob(suite, archivePath, instance)
+			}(instance)
+		}
+		return
+	}
+	numTests = len(g.gceImages.images)
+	workers := *provisionWorkers
+	if workers <= 0 || workers > numTests {
+		workers = numTests
+	}
+	// Queue the images in name order, so a limited worker count processes
+	// them deterministically.
+	names := make([]string, 0, numTests)
 	for shortName := range g.gceImages.images {
+		names = append(names, shortName)
+	}
+	sort.Strings(names)
+	jobs := make(chan imageJob, numTests)
+	for _, shortName := range names {
 		imageConfig := g.gceImages.images[shortName]
-		numTests++
 		fmt.Printf("Initializing e2e tests using image %s/%s/%s.\n", shortName, imageConfig.project, imageConfig.image)
-		go func(image *internalGCEImage, junitFileName string) {
-			results <- g.testGCEImage(suite, archivePath, image, junitFileName)
-		}(&imageConfig, shortName)
+		jobs <- imageJob{image: &imageConfig, junitFileName: shortName}
+	}
+	close(jobs)
+	for i := 0; i < workers; i++ {
+		go g.runImageJobs(suite, archivePath, jobs, results)
 	}
 	return
 }
 
-func getComputeClient() (*compute.Service, error) {
-	const retries = 10
-	const backoff = time.Second * 6
+// imageJob is one queued unit of work for a provisioning worker: an image to
+// provision and test, and the junit file name its results go to.
+type imageJob struct {
+	image         *internalGCEImage
+	junitFileName string
+}
 
-	// Setup the gce client for provisioning instances
-	// Getting credentials on gce jenkins is flaky, so try a couple times
-	var err error
-	var cs *compute.Service
-	for i := 0; i < retries; i++ {
-		if i > 0 {
-			time.Sleep(backoff)
+// runImageJobs is one provisioning worker. It consumes queued images and
+// emits exactly one result per image, so the caller can drain the results
+// channel by count.
+func (g *GCERunner) runImageJobs(suite remote.TestSuite, archivePath string, jobs <-chan imageJob, results chan<- *remote.TestResult) {
+	for job := range jobs {
+		results <- g.runImageJob(suite, archivePath, job)
+	}
+}
+
+// runImageTest is the per-image test entry point, replaceable in tests.
+var runImageTest = func(g *GCERunner, suite remote.TestSuite, archivePath string, image *internalGCEImage, junitFileName string) *remote.TestResult {
+	if *provisionOnly {
+		return g.provisionGCEInstance(image, junitFileName)
+	}
+	return g.testGCEImage(suite, archivePath, image, junitFileName)
+}
+
+// runImageJob runs a single image's tests, converting a panic into an error
+// result instead of killing the worker, so the promised result count still
+// adds up and the remaining images get processed.
+func (g *GCERunner) runImageJob(suite remote.TestSuite, archivePath string, job imageJob) (result *remote.TestResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			klog.Errorf("Worker testing image %s panicked: %v\n%s", job.image.image, r, debug.Stack())
+			result = &remote.TestResult{
+				Err:   fmt.Errorf("worker panicked while testing image %s: %v", job.image.image, r),
+				Image: job.image.image,
+			}
 		}
+	}()
+	return runImageTest(g, suite, archivePath, job.image, job.junitFileName)
+}
 
-		var client *http.Client
-		client, err = google.DefaultClient(context.Background(), compute.ComputeScope)
-		if err != nil {
-			continue
+// runStateJob runs the tests for one pre-provisioned instance, converting a
+// panic into an error result instead of killing the goroutine, so the caller
+// still receives the promised number of results and does not block forever.
+func (g *GCERunner) runStateJob(suite remote.TestSuite, archivePath string, instance provisionedInstance) (result *remote.TestResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			klog.Errorf("Worker testing instance %s panicked: %v\n%s", instance.Host, r, debug.Stack())
+			result = &remote.TestResult{
+				Err:   fmt.Errorf("worker panicked while testing instance %s: %v", instance.Host, r),
+				Host:  instance.Host,
+				Image: instance.Image,
+			}
+		}
+	}()
+	return g.testProvisionedInstance(suite, archivePath, instance)
+}
+
+// validateSSHKeys checks that the SSH key material used to reach instances
+// exists and is readable.
+func validateSSHKeys() error {
+	if pubKeyFile := os.Getenv("GCE_SSH_PUBLIC_KEY_FILE"); pubKeyFile != "" {
+		if _, err := os.ReadFile(pubKeyFile); err != nil {
+			return fmt.Errorf("unable to read GCE_SSH_PUBLIC_KEY_FILE %q: %w", pubKeyFile, err)
 		}
+	}
+	if key, err := remote.GetPrivateSSHKey(""); err != nil {
+		return fmt.Errorf("private SSH key %q is not available: %w", key, err)
+	}
+	return nil
+}
+
+// computeServiceFactory creates a compute service for a single attempt.
+type computeServiceFactory func() (*compute.Service, error)
+
+func defaultComputeServiceFactory() (*compute.Service, error) {
+	opts, err := computeServiceOptions()
+	if err != nil {
+		return nil, err
+	}
+	cs, err := compute.NewService(context.Background(), opts...)
+	if err != nil && *gcpCredentialsFile != "" {
+		return nil, fmt.Errorf("failed to create gce compute client from credentials file %q: %w", *gcpCredentialsFile, err)
+	}
+	return cs, err
+}
 
-		cs, err = compute.NewService(context.Background(), option.WithHTTPClient(client))
+// computeServiceOptions returns the client options implied by the credential
+// flags: an impersonated token source for --impersonate-service-account
+// (sourced from --gcp-credentials-file when set), the credentials file alone,
+// or the application default client.
+func computeServiceOptions() ([]option.ClientOption, error) {
+	if *impersonateServiceAccount != "" {
+		var srcOpts []option.ClientOption
+		if *gcpCredentialsFile != "" {
+			srcOpts = append(srcOpts, option.WithCredentialsFile(*gcpCredentialsFile))
+		}
+		ts, err := impersonate.CredentialsTokenSource(context.Background(), impersonate.CredentialsConfig{
+			TargetPrincipal: *impersonateServiceAccount,
+			Scopes:          []string{compute.CloudPlatformScope},
+		}, srcOpts...)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("unable to impersonate service account %q: %w", *impersonateServiceAccount, err)
+		}
+		return []option.ClientOption{option.WithTokenSource(ts)}, nil
+	}
+	if *gcpCredentialsFile != "" {
+		return []option.ClientOption{option.WithCredentialsFile(*gcpCredentialsFile)}, nil
+	}
+	client, err := google.DefaultClient(context.Background(), compute.ComputeScope)
+	if err != nil {
+		return nil, err
+	}
+	return []option.ClientOption{option.WithHTTPClient(client)}, nil
+}
+
+// getComputeClient sets up the gce client for provisioning instances. Getting
+// credentials on gce jenkins is flaky, so retry with exponential backoff as
+// configured by --compute-client-retries and --compute-client-backoff.
+func getComputeClient(factory computeServiceFactory) (*compute.Service, error) {
+	backoff := wait.Backoff{
+		Duration: *computeClientBackoff,
+		Factor:   2,
+		Steps:    *computeClientRetries,
+	}
+
+	var cs *compute.Service
+	var lastErr error
+	attempts := 0
+	if waitErr := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		attempts++
+		cs, lastErr = factory()
+		return lastErr == nil, nil
+	}); waitErr != nil {
+		if lastErr != nil {
+			return nil, fmt.Errorf("failed to create gce compute client after %d attempts: %w", attempts, lastErr)
 		}
-		return cs, nil
+		return nil, waitErr
 	}
-	return nil, err
+	return cs, nil
 }
 
 // Accelerator contains type and count about resource.
 type Accelerator struct {
-	Type  string `json:"type,omitempty"`
-	Count int64  `json:"count,omitempty"`
+	Type  string `json:"type,omitempty" toml:"type"`
+	Count int64  `json:"count,omitempty" toml:"count"`
 }
 
 // Resources contains accelerators array.
 type Resources struct {
-	Accelerators []Accelerator `json:"accelerators,omitempty"`
+	Accelerators []Accelerator `json:"accelerators,omitempty" toml:"accelerators"`
 }
 
 // internalGCEImage is an internal GCE image representation for E2E node.
@@ -173,10 +630,39 @@ type internalGCEImage struct {
 	// 'image' will be used.
 	imageDesc       string
 	kernelArguments []string
-	project         string
-	resources       Resources
-	metadata        *compute.Metadata
-	machine         string
+	// project is the project the image is resolved from, which may differ
+	// from the --project the instance is launched into.
+	project string
+	// launchProject is the project the instance is launched into, defaulting
+	// to --project.
+	launchProject string
+	resources     Resources
+	metadata      *compute.Metadata
+	machine       string
+	localSSDCount int64
+	// guestOsFeatures are feature types advertised on the boot disk.
+	guestOsFeatures []string
+	// tests and skip are per-image ginkgo focus/skip filters merged into the
+	// shared ginkgo flags for this image's run.
+	tests []string
+	skip  string
+	// gpuDriverVersion is the GPU driver version to install for images with
+	// accelerators, defaulting to "latest".
+	gpuDriverVersion string
+	// serviceAccount and serviceAccountScopes override the instance service
+	// account. If empty, the --service-account flags or the project default
+	// service account are used.
+	serviceAccount       string
+	serviceAccountScopes []string
+	// deleteInstance overrides the global DeleteInstances setting for this
+	// image when non-nil.
+	deleteInstance *bool
+	// sshUser overrides the user SSH connections to this image's instance
+	// are made as. If empty, the --ssh-user/environment default applies.
+	sshUser string
+	// zone the instance for this image was created in, so that per-host
+	// operations (delete, serial log, IP registration) target the right zone.
+	zone string
 }
 
 type internalGCEImageConfig struct {
@@ -185,8 +671,8 @@ type internalGCEImageConfig struct {
 
 // GCEImageConfig specifies what images should be run and how for these tests.
 // It can be created via the `--images` and `--image-project` flags, or by
-// specifying the `--image-config-file` flag, pointing to a json or yaml file
-// of the form:
+// specifying the `--image-config-file` flag, pointing to a json, yaml or
+// toml (by `.toml` extension) file of the form:
 //
 //	images:
 //	  short-name:
@@ -198,25 +684,173 @@ type internalGCEImageConfig struct {
 // TODO(coufon): replace 'image' with 'node' in configurations
 // and we plan to support testing custom machines other than GCE by specifying Host
 type GCEImageConfig struct {
-	Images map[string]GCEImage `json:"images"`
+	Images map[string]GCEImage `json:"images" toml:"images"`
 }
 
 // GCEImage contains some information about GCE Image.
 type GCEImage struct {
-	Image      string `json:"image,omitempty"`
-	ImageRegex string `json:"image_regex,omitempty"`
+	Image      string `json:"image,omitempty" toml:"image"`
+	ImageRegex string `json:"image_regex,omitempty" toml:"image_regex"`
 	// ImageFamily is the image family to use. The latest image from the image family will be used, e.g cos-81-lts.
-	ImageFamily     string    `json:"image_family,omitempty"`
-	ImageDesc       string    `json:"image_description,omitempty"`
-	KernelArguments []string  `json:"kernel_arguments,omitempty"`
-	Project         string    `json:"project"`
-	Metadata        string    `json:"metadata"`
-	Machine         string    `json:"machine,omitempty"`
-	Resources       Resources `json:"resources,omitempty"`
+	ImageFamily string `json:"image_family,omitempty" toml:"image_family"`
+	// Architecture restricts regex/family image resolution to images of the
+	// given architecture (ARM64 or X86_64), e.g. for t2a machine types.
+	Architecture    string   `json:"architecture,omitempty" toml:"architecture"`
+	ImageDesc       string   `json:"image_description,omitempty" toml:"image_description"`
+	KernelArguments []string `json:"kernel_arguments,omitempty" toml:"kernel_arguments"`
+	Project         string   `json:"project" toml:"project"`
+	// ImageProject is the project the image is resolved from when it differs
+	// from Project, e.g. to pull a public cos-cloud image while launching into
+	// our own project. Defaults to Project.
+	ImageProject string `json:"image_project,omitempty" toml:"image_project"`
+	// LaunchProject is the project the instance for this image is launched
+	// into, e.g. for multi-project test matrices. Defaults to --project.
+	LaunchProject string `json:"launch_project,omitempty" toml:"launch_project"`
+	Metadata      string `json:"metadata" toml:"metadata"`
+	Machine       string `json:"machine,omitempty" toml:"machine"`
+	// Machines sweeps this image across several machine types, expanding into
+	// one test run per entry, e.g. for benchmarks comparing instance sizes.
+	// Mutually exclusive with Machine.
+	Machines []string `json:"machines,omitempty" toml:"machines"`
+	// Tests is a list of ginkgo focus strings, e.g. for benchmark configs;
+	// tests matching any entry run for this image. Empty keeps the shared
+	// ginkgo flags unchanged.
+	Tests []string `json:"tests,omitempty" toml:"tests"`
+	// Skip is a ginkgo skip string excluding matching tests for this image.
+	Skip      string    `json:"skip,omitempty" toml:"skip"`
+	Resources Resources `json:"resources,omitempty" toml:"resources"`
+	// LocalSSDCount is the number of SCRATCH local SSDs with NVMe interface
+	// to attach to the instance, e.g. for local-volume and ephemeral-storage
+	// tests. Local SSDs have a fixed size of 375GB each.
+	LocalSSDCount int64 `json:"local_ssd_count,omitempty" toml:"local_ssd_count"`
+	// GuestOsFeatures are GCE guest OS feature types (e.g. UEFI_COMPATIBLE,
+	// SEV_CAPABLE) advertised on the boot disk, e.g. for Shielded or
+	// Confidential combinations on custom images.
+	GuestOsFeatures []string `json:"guest_os_features,omitempty" toml:"guest_os_features"`
+	// GpuDriverVersion pins the GPU driver version installed for images with
+	// accelerators. Defaults to "latest".
+	GpuDriverVersion string `json:"gpu_driver_version,omitempty" toml:"gpu_driver_version"`
+	// ServiceAccount is the service account email to run the instance as,
+	// overriding the project default service account.
+	ServiceAccount string `json:"service_account,omitempty" toml:"service_account"`
+	// ServiceAccountScopes are the OAuth scopes granted to ServiceAccount.
+	// Required when ServiceAccount is set.
+	ServiceAccountScopes []string `json:"service_account_scopes,omitempty" toml:"service_account_scopes"`
+	// DeleteInstance overrides the global --delete-instances setting for this
+	// image, e.g. to keep a single debug instance in an otherwise throwaway
+	// matrix.
+	DeleteInstance *bool `json:"delete_instance,omitempty" toml:"delete_instance"`
+	// SSHUser is the user SSH connections to this image's instance are made
+	// as, e.g. 'core' on Flatcar. If empty, the --ssh-user/environment
+	// default applies.
+	SSHUser string `json:"ssh_user,omitempty" toml:"ssh_user"`
+}
+
+// validArchitectures are the values accepted in an image's architecture
+// field.
+var validArchitectures = map[string]bool{"ARM64": true, "X86_64": true}
+
+// validGuestOsFeatures are the guest OS feature types GCE accepts on a boot
+// disk.
+var validGuestOsFeatures = map[string]bool{
+	"GVNIC":                     true,
+	"MULTI_IP_SUBNET":           true,
+	"SECURE_BOOT":               true,
+	"SEV_CAPABLE":               true,
+	"SEV_SNP_CAPABLE":           true,
+	"SUSPEND_RESUME_COMPATIBLE": true,
+	"TDX_CAPABLE":               true,
+	"UEFI_COMPATIBLE":           true,
+	"VIRTIO_SCSI_MULTIQUEUE":    true,
+	"WINDOWS":                   true,
+}
+
+// gpuCapableMachineFamilies are the machine families guest accelerators can
+// be attached to (N1, including the bare custom-<cpu>-<mem> form) or that
+// ship with GPUs built in (A2/A3/G2).
+var gpuCapableMachineFamilies = map[string]bool{"n1": true, "a2": true, "a3": true, "g2": true, "custom": true}
+
+// gpuCapableMachine reports whether the given machine type can carry guest
+// accelerators. An empty machine is left to the API to validate, as the
+// effective type depends on the --instance-type flag.
+func gpuCapableMachine(machine string) bool {
+	if machine == "" {
+		return true
+	}
+	family, _, found := strings.Cut(machine, "-")
+	if !found {
+		return false
+	}
+	return gpuCapableMachineFamilies[family]
+}
+
+// validateImageConfig checks the parsed image config and reports every
+// problem at once, so large config files can be fixed in a single edit
+// instead of one error per run.
+func validateImageConfig(config *GCEImageConfig) error {
+	names := make([]string, 0, len(config.Images))
+	for name := range config.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		img := config.Images[name]
+		if img.Project == "" && img.ImageProject == "" {
+			errs = append(errs, fmt.Errorf("%s: project must be set", name))
+		}
+		// An explicit image is used verbatim, so combining it with the
+		// regex/family filters would silently ignore them.
+		if img.Image != "" && (img.ImageRegex != "" || img.ImageFamily != "") {
+			errs = append(errs, fmt.Errorf("%s: image is mutually exclusive with image_regex and image_family", name))
+		}
+		if img.Machine != "" && len(img.Machines) > 0 {
+			errs = append(errs, fmt.Errorf("%s: machine is mutually exclusive with machines", name))
+		}
+		for _, machine := range append([]string{img.Machine}, img.Machines...) {
+			if machine == "" {
+				continue
+			}
+			if err := validateCustomMachineType(machine); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			}
+		}
+		if img.Architecture != "" && !validArchitectures[strings.ToUpper(img.Architecture)] {
+			errs = append(errs, fmt.Errorf("%s: unknown architecture %q, must be ARM64 or X86_64", name, img.Architecture))
+		}
+		if img.LocalSSDCount < 0 {
+			errs = append(errs, fmt.Errorf("%s: local_ssd_count must not be negative, got %d", name, img.LocalSSDCount))
+		}
+		for _, feature := range img.GuestOsFeatures {
+			if !validGuestOsFeatures[strings.ToUpper(feature)] {
+				errs = append(errs, fmt.Errorf("%s: unknown guest OS feature %q", name, feature))
+			}
+		}
+		for _, acc := range img.Resources.Accelerators {
+			if acc.Type == "" {
+				errs = append(errs, fmt.Errorf("%s: accelerator type must be set", name))
+			}
+			if acc.Count <= 0 {
+				errs = append(errs, fmt.Errorf("%s: accelerator %q count must be positive, got %d", name, acc.Type, acc.Count))
+			}
+		}
+		if len(img.Resources.Accelerators) > 0 {
+			for _, machine := range append([]string{img.Machine}, img.Machines...) {
+				if machine != "" && !gpuCapableMachine(machine) {
+					errs = append(errs, fmt.Errorf("%s: machine type %q cannot have guest accelerators attached, use an N1, A2, A3 or G2 machine", name, machine))
+				}
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
 }
 
 // Returns an image name based on regex and given GCE project.
-func (g *GCERunner) getGCEImage(imageRegex, imageFamily string, project string) (string, error) {
+func (g *GCERunner) getGCEImage(imageRegex, imageFamily, architecture string, project string) (string, error) {
+	cacheKey := strings.Join([]string{project, imageRegex, imageFamily, architecture}, "|")
+	if image, ok := g.resolvedImages[cacheKey]; ok {
+		return image, nil
+	}
 	imageObjs := []imageObj{}
 	imageRe := regexp.MustCompile(imageRegex)
 	if err := g.gceComputeService.Images.List(project).Pages(context.Background(),
@@ -228,6 +862,12 @@ func (g *GCERunner) getGCEImage(imageRegex, imageFamily string, project string)
 				if imageFamily != "" && instance.Family != imageFamily {
 					continue
 				}
+				if architecture != "" && !strings.EqualFold(instance.Architecture, architecture) {
+					continue
+				}
+				if !*allowDeprecatedImages && isDeprecatedImage(instance) {
+					continue
+				}
 				creationTime, err := time.Parse(time.RFC3339, instance.CreationTimestamp)
 				if err != nil {
 					return fmt.Errorf("failed to parse instance creation timestamp %q: %w", instance.CreationTimestamp, err)
@@ -247,10 +887,76 @@ func (g *GCERunner) getGCEImage(imageRegex, imageFamily string, project string)
 	// Pick the latest image after sorting.
 	sort.Sort(byCreationTime(imageObjs))
 	if len(imageObjs) > 0 {
-		klog.V(4).Infof("found images %+v based on regex %q and family %q in project %q", imageObjs, imageRegex, imageFamily, project)
+		klog.V(4).Infof("found images %+v based on regex %q, family %q and architecture %q in project %q", imageObjs, imageRegex, imageFamily, architecture, project)
+		if g.resolvedImages == nil {
+			g.resolvedImages = make(map[string]string)
+		}
+		g.resolvedImages[cacheKey] = imageObjs[0].name
 		return imageObjs[0].name, nil
 	}
-	return "", fmt.Errorf("found zero images based on regex %q and family %q in project %q", imageRegex, imageFamily, project)
+	return "", fmt.Errorf("found zero images based on regex %q, family %q and architecture %q in project %q", imageRegex, imageFamily, architecture, project)
+}
+
+// isDeprecatedImage reports whether GCE marked the image as no longer fit for
+// new instances.
+func isDeprecatedImage(image *compute.Image) bool {
+	if image.Deprecated == nil {
+		return false
+	}
+	switch image.Deprecated.State {
+	case "DEPRECATED", "OBSOLETE", "DELETED":
+		return true
+	}
+	return false
+}
+
+// fetchGCSObject downloads gs://<bucket>/<object>, replaceable in tests.
+var fetchGCSObject = func(g *GCERunner, bucket, object string) ([]byte, error) {
+	ctx := context.Background()
+	client, err := g.storageClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	defer client.Close()
+	r, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not open gs://%s/%s: %w", bucket, object, err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// readImageConfig loads the image config from --image-config-file, which may
+// be a local path, an http(s) URL or a gs:// object. --image-config-dir
+// joining only applies to local paths.
+func (g *GCERunner) readImageConfig() ([]byte, error) {
+	configPath := g.cfg.ImageConfigFile
+	switch {
+	case strings.HasPrefix(configPath, "gs://"):
+		bucket, object, found := strings.Cut(strings.TrimPrefix(configPath, "gs://"), "/")
+		if !found || bucket == "" || object == "" {
+			return nil, fmt.Errorf("invalid GCS image config path %q, expected gs://bucket/object", configPath)
+		}
+		return fetchGCSObject(g, bucket, object)
+	case strings.HasPrefix(configPath, "http://"), strings.HasPrefix(configPath, "https://"):
+		resp, err := http.Get(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch image config from %q: %w", configPath, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("could not fetch image config from %q: %s", configPath, resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+	if g.cfg.ImageConfigDir != "" {
+		configPath = filepath.Join(g.cfg.ImageConfigDir, configPath)
+	}
+	imageConfigData, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read image config file provided: %w", err)
+	}
+	return imageConfigData, nil
 }
 
 func (g *GCERunner) prepareGceImages() (*internalGCEImageConfig, error) {
@@ -260,27 +966,39 @@ func (g *GCERunner) prepareGceImages() (*internalGCEImageConfig, error) {
 
 	// Parse images from given config file and convert them to internalGCEImage.
 	if g.cfg.ImageConfigFile != "" {
-		configPath := g.cfg.ImageConfigFile
-		if g.cfg.ImageConfigDir != "" {
-			configPath = filepath.Join(g.cfg.ImageConfigDir, g.cfg.ImageConfigFile)
-		}
-
-		imageConfigData, err := os.ReadFile(configPath)
+		imageConfigData, err := g.readImageConfig()
 		if err != nil {
-			return nil, fmt.Errorf("Could not read image config file provided: %w", err)
+			return nil, err
 		}
 		// Unmarshal the given image config file. All images for this test run will be organized into a map.
 		// shortName->GCEImage, e.g cos-stable->cos-stable-81-12871-103-0.
 		externalImageConfig := GCEImageConfig{Images: make(map[string]GCEImage)}
-		err = yaml.Unmarshal(imageConfigData, &externalImageConfig)
+		if strings.HasSuffix(g.cfg.ImageConfigFile, ".toml") {
+			err = toml.Unmarshal(imageConfigData, &externalImageConfig)
+		} else {
+			err = yaml.Unmarshal(imageConfigData, &externalImageConfig)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("Could not parse image config file: %w", err)
 		}
+		if err := validateImageConfig(&externalImageConfig); err != nil {
+			return nil, fmt.Errorf("invalid image config file: %w", err)
+		}
 
 		for shortName, imageConfig := range externalImageConfig.Images {
+			// The image may live in a different project than the instance is
+			// launched into, e.g. a public cos-cloud image.
+			resolveProject := imageConfig.ImageProject
+			if resolveProject == "" {
+				resolveProject = imageConfig.Project
+			}
+			// An explicit image wins and is used verbatim; otherwise the
+			// regex and family filters apply together and the newest
+			// non-deprecated match is picked. validateImageConfig rejected
+			// configs setting both up front.
 			var image string
 			if (imageConfig.ImageRegex != "" || imageConfig.ImageFamily != "") && imageConfig.Image == "" {
-				image, err = g.getGCEImage(imageConfig.ImageRegex, imageConfig.ImageFamily, imageConfig.Project)
+				image, err = g.getGCEImage(imageConfig.ImageRegex, imageConfig.ImageFamily, imageConfig.Architecture, resolveProject)
 				if err != nil {
 					return nil, fmt.Errorf("Could not retrieve a image based on image regex %q and family %q: %v",
 						imageConfig.ImageRegex, imageConfig.ImageFamily, err)
@@ -293,18 +1011,50 @@ func (g *GCERunner) prepareGceImages() (*internalGCEImageConfig, error) {
 			if len(strings.TrimSpace(*instanceMetadata)) > 0 {
 				metadata += "," + *instanceMetadata
 			}
+			if imageConfig.ServiceAccount != "" && len(imageConfig.ServiceAccountScopes) == 0 {
+				return nil, fmt.Errorf("invalid config for %v; service_account_scopes must be set when service_account is set", shortName)
+			}
+			if imageConfig.LocalSSDCount < 0 || imageConfig.LocalSSDCount > maxLocalSSDCount {
+				return nil, fmt.Errorf("invalid config for %v; local_ssd_count must be between 0 and %d, got %d",
+					shortName, maxLocalSSDCount, imageConfig.LocalSSDCount)
+			}
 			gceImage := internalGCEImage{
-				image:           image,
-				imageDesc:       imageConfig.ImageDesc,
-				project:         imageConfig.Project,
-				metadata:        g.getImageMetadata(metadata),
-				kernelArguments: imageConfig.KernelArguments,
-				machine:         imageConfig.Machine,
-				resources:       imageConfig.Resources,
+				image:                image,
+				imageDesc:            imageConfig.ImageDesc,
+				project:              resolveProject,
+				launchProject:        imageConfig.LaunchProject,
+				metadata:             g.getImageMetadata(metadata),
+				kernelArguments:      imageConfig.KernelArguments,
+				machine:              imageConfig.Machine,
+				tests:                imageConfig.Tests,
+				skip:                 imageConfig.Skip,
+				resources:            imageConfig.Resources,
+				localSSDCount:        imageConfig.LocalSSDCount,
+				guestOsFeatures:      imageConfig.GuestOsFeatures,
+				gpuDriverVersion:     imageConfig.GpuDriverVersion,
+				serviceAccount:       imageConfig.ServiceAccount,
+				serviceAccountScopes: imageConfig.ServiceAccountScopes,
+				deleteInstance:       imageConfig.DeleteInstance,
+				sshUser:              imageConfig.SSHUser,
 			}
 			if gceImage.imageDesc == "" {
 				gceImage.imageDesc = gceImage.image
 			}
+			if gceImage.gpuDriverVersion == "" {
+				gceImage.gpuDriverVersion = defaultGPUDriverVersion
+			}
+			if len(imageConfig.Machines) > 0 {
+				// Sweep the image across every requested machine type; each
+				// expands into its own internal image and test run. Instance
+				// names stay unique through the uuid suffix machine-based
+				// names get in imageToInstanceName.
+				for _, machine := range imageConfig.Machines {
+					machineImage := gceImage
+					machineImage.machine = machine
+					gceImages.images[fmt.Sprintf("%s-%s", shortName, machine)] = machineImage
+				}
+				continue
+			}
 			gceImages.images[shortName] = gceImage
 		}
 	}
@@ -325,8 +1075,14 @@ func (g *GCERunner) prepareGceImages() (*internalGCEImageConfig, error) {
 		}
 	}
 
-	if len(gceImages.images) != 0 && *zone == "" {
-		return nil, errors.New("must specify --zone flag")
+	// If the user asked for images but none resolved, fail loudly instead of
+	// reporting zero started tests as success.
+	if (g.cfg.ImageConfigFile != "" || len(g.cfg.Images) > 0) && len(gceImages.images) == 0 {
+		return nil, errors.New("no images were resolved from --image-config-file or --images")
+	}
+
+	if len(gceImages.images) != 0 && *zone == "" && *zones == "" {
+		return nil, errors.New("must specify --zone or --zones flag")
 	}
 	// Make sure GCP project is set. Without a project, images can't be retrieved..
 	for shortName, imageConfig := range gceImages.images {
@@ -373,109 +1129,649 @@ func (g *GCERunner) getImageMetadata(input string) *compute.Metadata {
 	return &ret
 }
 
-func (g *GCERunner) deleteGCEInstance(host string) {
-	klog.Infof("Deleting instance %q", host)
-	_, err := g.gceComputeService.Instances.Delete(*project, *zone, host).Do()
-	if err != nil {
-		klog.Errorf("Error deleting instance %q: %v", host, err)
+// testZones returns the zones instances may be created in: the --zones list
+// when given, otherwise the single --zone.
+func (g *GCERunner) testZones() []string {
+	if *zones != "" {
+		return strings.Split(*zones, ",")
 	}
+	return []string{*zone}
 }
 
-func (g *GCERunner) parseInstanceMetadata(str string) map[string]string {
-	metadata := make(map[string]string)
-	ss := strings.Split(str, ",")
-	for _, s := range ss {
-		kv := strings.Split(s, "=")
-		if len(kv) == 2 {
-			metadata[kv[0]] = kv[1]
-			continue
-		}
-		kp := strings.Split(s, "<")
-		if len(kp) != 2 {
-			klog.Fatalf("Invalid instance metadata: %q", s)
-			continue
-		}
-		metaPath := kp[1]
-		if g.cfg.ImageConfigDir != "" {
-			metaPath = filepath.Join(g.cfg.ImageConfigDir, metaPath)
-		}
-		v, err := os.ReadFile(metaPath)
-		if err != nil {
-			klog.Fatalf("Failed to read metadata file %q: %v", metaPath, err)
-			continue
-		}
-		metadata[kp[0]] = ignitionInjectGCEPublicKey(metaPath, string(v))
-	}
-	for k, v := range nodeEnvs {
-		metadata[k] = v
+// pickZone returns the zone to create the next instance in, cycling through
+// the configured zones round-robin.
+func (g *GCERunner) pickZone() string {
+	zs := g.testZones()
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	z := zs[g.nextZoneIndex%len(zs)]
+	g.nextZoneIndex++
+	return z
+}
+
+// recordHostZone remembers the zone an instance was created in.
+func (g *GCERunner) recordHostZone(host, zone string) {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	if g.hostZones == nil {
+		g.hostZones = make(map[string]string)
 	}
-	return metadata
+	g.hostZones[host] = zone
 }
 
-// ignitionInjectGCEPublicKey tries to inject the GCE SSH public key into the
-// provided ignition file path.
-//
-// This will only being done if the job has the
-// IGNITION_INJECT_GCE_SSH_PUBLIC_KEY_FILE environment variable set, while it
-// tried to replace the GCE_SSH_PUBLIC_KEY_FILE_CONTENT placeholder.
-func ignitionInjectGCEPublicKey(path string, content string) string {
-	if os.Getenv("IGNITION_INJECT_GCE_SSH_PUBLIC_KEY_FILE") == "" {
-		return content
+// recordHostProject remembers the project an instance was launched into.
+func (g *GCERunner) recordHostProject(host, project string) {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	if g.hostProjects == nil {
+		g.hostProjects = make(map[string]string)
 	}
+	g.hostProjects[host] = project
+}
 
-	klog.Infof("Injecting SSH public key into ignition")
+// pollContext returns the context provisioning polls run under, which the
+// shutdown signal handler cancels.
+func (g *GCERunner) pollContext() context.Context {
+	if g.pollCtx == nil {
+		return context.Background()
+	}
+	return g.pollCtx
+}
 
-	const publicKeyEnv = "GCE_SSH_PUBLIC_KEY_FILE"
-	sshPublicKeyFile := os.Getenv(publicKeyEnv)
-	if sshPublicKeyFile == "" {
-		klog.Errorf("Environment variable %s is not set", publicKeyEnv)
+// handleShutdownSignals deletes all in-flight instances and exits non-zero
+// when SIGTERM arrives, so a run killed by CI does not leak instances. SIGINT
+// is owned by the handler in RunRemoteTestSuite, which deliberately ignores
+// the first one so artifacts can be gathered and calls CleanupOnInterrupt
+// before exiting on the second.
+func (g *GCERunner) handleShutdownSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		klog.Errorf("Received %v, cleaning up in-flight instances", sig)
+		g.CleanupOnInterrupt()
 		os.Exit(1)
+	}()
+}
+
+// CleanupOnInterrupt aborts in-flight provisioning polls and best-effort
+// deletes the instances this run created. It implements
+// remote.InterruptCleaner, so the suite-level SIGINT handler can release the
+// run's instances before exiting.
+func (g *GCERunner) CleanupOnInterrupt() {
+	if g.pollCancel != nil {
+		g.pollCancel()
 	}
+	g.shutdown()
+}
 
-	sshPublicKey, err := os.ReadFile(sshPublicKeyFile)
-	if err != nil {
-		klog.ErrorS(err, "unable to read SSH public key file")
-		os.Exit(1)
+// shutdown best-effort deletes the instances currently tracked in the
+// host→zone map, bounded by shutdownGracePeriod. Reused and explicitly kept
+// instances survive an interrupted run the same way they survive a completed
+// one.
+func (g *GCERunner) shutdown() {
+	if !g.cfg.DeleteInstances {
+		return
 	}
+	g.zoneMu.Lock()
+	hosts := make([]string, 0, len(g.hostZones))
+	for host := range g.hostZones {
+		if g.reusedInstances[host] || g.keptHosts[host] {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	g.zoneMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for _, host := range hosts {
+			wg.Add(1)
+			go func(host string) {
+				defer wg.Done()
+				g.deleteGCEInstance(host)
+			}(host)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownGracePeriod):
+		klog.Errorf("Timed out deleting in-flight instances after %v", shutdownGracePeriod)
+	}
+}
 
-	const sshPublicKeyFileContentMarker = "GCE_SSH_PUBLIC_KEY_FILE_CONTENT"
-	key := base64.StdEncoding.EncodeToString(sshPublicKey)
-	base64Marker := base64.StdEncoding.EncodeToString([]byte(sshPublicKeyFileContentMarker))
-	replacer := strings.NewReplacer(
-		sshPublicKeyFileContentMarker, key,
-		base64Marker, key,
-	)
-	return replacer.Replace(content)
+// now returns the current time from the runner clock, which tests can fake.
+func (g *GCERunner) now() time.Time {
+	if g.clock == nil {
+		return time.Now()
+	}
+	return g.clock.Now()
 }
 
-// Provision a gce instance using image and run the tests in archive against the instance.
-// Delete the instance afterward.
-func (g *GCERunner) testGCEImage(suite remote.TestSuite, archivePath string, imageConfig *internalGCEImage, junitFileName string) *remote.TestResult {
-	ginkgoFlagsStr := g.cfg.GinkgoFlags
+// markInstanceBooting records the start of the boot phase, i.e. the moment the
+// insert operation was first observed DONE. Repeated calls for the same
+// instance keep the first observation, so the measurement excludes the insert
+// operation and any subsequent poll iterations.
+func (g *GCERunner) markInstanceBooting(host string) {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	if g.bootStarts == nil {
+		g.bootStarts = make(map[string]time.Time)
+	}
+	if _, ok := g.bootStarts[host]; !ok {
+		g.bootStarts[host] = g.now()
+	}
+}
 
-	host, err := g.createGCEInstance(imageConfig)
-	if g.cfg.DeleteInstances {
-		defer g.deleteGCEInstance(host)
+// markInstanceBooted records the end of the boot phase, i.e. the instance
+// being SSH-ready, and stores the measured boot time.
+func (g *GCERunner) markInstanceBooted(host string) {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	start, ok := g.bootStarts[host]
+	if !ok {
+		return
 	}
-	if err != nil {
-		return &remote.TestResult{
-			Err: fmt.Errorf("unable to create gce instance with running docker daemon for image %s.  %v", imageConfig.image, err),
-		}
+	if g.hostBootTimes == nil {
+		g.hostBootTimes = make(map[string]time.Duration)
 	}
+	g.hostBootTimes[host] = g.now().Sub(start)
+}
 
-	// Only delete the files if we are keeping the instance and want it cleaned up.
-	// If we are going to delete the instance, don't bother with cleaning up the files
-	deleteFiles := !g.cfg.DeleteInstances && g.cfg.Cleanup
+// hostBootTime returns the measured boot time of the given instance, or zero
+// when it was not measured.
+func (g *GCERunner) hostBootTime(host string) time.Duration {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	return g.hostBootTimes[host]
+}
 
-	if err = g.registerGceHostIP(host); err != nil {
-		return &remote.TestResult{
-			Err:    err,
-			Host:   host,
-			ExitOK: false,
-		}
+// markInstanceReused records that the given instance pre-existed and was
+// adopted instead of created, so it is kept after the run.
+func (g *GCERunner) markInstanceReused(host string) {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	if g.reusedInstances == nil {
+		g.reusedInstances = make(map[string]bool)
 	}
+	g.reusedInstances[host] = true
+}
+
+// instanceReused reports whether the given instance was adopted via
+// --reuse-instances rather than created by this run.
+func (g *GCERunner) instanceReused(host string) bool {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	return g.reusedInstances[host]
+}
+
+// markHostKept records that the given instance must outlive the run, because
+// its image sets delete_instance=false or --keep-on-failure kept it for
+// debugging, so the shutdown signal handler does not delete it either.
+func (g *GCERunner) markHostKept(host string) {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	if g.keptHosts == nil {
+		g.keptHosts = make(map[string]bool)
+	}
+	g.keptHosts[host] = true
+}
+
+// recordEvent appends an entry to the run timeline. Events are recorded in
+// the order they happen across all hosts.
+func (g *GCERunner) recordEvent(host, event string) {
+	g.timelineMu.Lock()
+	defer g.timelineMu.Unlock()
+	g.timeline = append(g.timeline, timelineEvent{Host: host, Event: event, Time: g.now()})
+}
+
+// writeTimeline exports the run timeline collected so far as timeline.json in
+// the results directory. It is rewritten after each image run, so the
+// timeline stays usable when a later run wedges.
+func (g *GCERunner) writeTimeline() error {
+	g.timelineMu.Lock()
+	defer g.timelineMu.Unlock()
+	if len(g.timeline) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(g.timeline, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(remote.ResultsDir(), "timeline.json"), data, 0644)
+}
+
+// hostZone returns the zone the given instance was created in, falling back
+// to the global --zone for hosts this runner did not create.
+func (g *GCERunner) hostZone(host string) string {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	if z, ok := g.hostZones[host]; ok {
+		return z
+	}
+	return *zone
+}
+
+// ActiveHosts returns the names of the instances this runner currently has
+// alive, in sorted order. It implements remote.HostLister.
+func (g *GCERunner) ActiveHosts() []string {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	hosts := make([]string, 0, len(g.hostZones))
+	for host := range g.hostZones {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// forgetHost drops a deleted instance from the host tracking maps, so it no
+// longer shows up as active.
+func (g *GCERunner) forgetHost(host string) {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	delete(g.hostZones, host)
+	delete(g.hostProjects, host)
+}
+
+// hostProject returns the project the given instance was launched into,
+// falling back to the global --project for hosts this runner did not create.
+func (g *GCERunner) hostProject(host string) string {
+	g.zoneMu.Lock()
+	defer g.zoneMu.Unlock()
+	if p, ok := g.hostProjects[host]; ok {
+		return p
+	}
+	return *project
+}
+
+// launchProject returns the project the instance for the given image is
+// launched into, honoring the per-image launch_project override.
+func (g *GCERunner) launchProject(imageConfig *internalGCEImage) string {
+	if imageConfig.launchProject != "" {
+		return imageConfig.launchProject
+	}
+	return *project
+}
+
+// shouldDeleteInstance reports whether the instance for the given image should
+// be deleted after the test, honoring the per-image delete_instance override.
+func (g *GCERunner) shouldDeleteInstance(imageConfig *internalGCEImage) bool {
+	if imageConfig.deleteInstance != nil {
+		return *imageConfig.deleteInstance
+	}
+	return g.cfg.DeleteInstances
+}
+
+// validateAllowedZones checks that every configured zone is covered by the
+// --allowed-zones allowlist. An empty allowlist means unrestricted.
+func validateAllowedZones() error {
+	if *allowedZones == "" {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, z := range strings.Split(*allowedZones, ",") {
+		allowed[z] = true
+	}
+	for _, z := range strings.Split(*zones+","+*zone, ",") {
+		if z == "" {
+			continue
+		}
+		if !allowed[z] {
+			return fmt.Errorf("zone %q is not in the --allowed-zones allowlist %q", z, *allowedZones)
+		}
+	}
+	return nil
+}
+
+// parseLabelSelector parses a comma-separated k=v label selector string.
+func parseLabelSelector(selector string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, s := range strings.Split(selector, ",") {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label selector entry %q, expected k=v", s)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// matchesCleanupFilters reports whether the instance matches both the name
+// prefix and all selector labels. Instances share an org-wide name prefix, so
+// the label selector is what narrows cleanup down to a single run.
+func matchesCleanupFilters(instance *compute.Instance, namePrefix string, selector map[string]string) bool {
+	if !strings.HasPrefix(instance.Name, namePrefix) {
+		return false
+	}
+	for k, v := range selector {
+		if instance.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteOrphanInstances deletes instances left behind by earlier runs in the
+// configured zones, matching both --cleanup-name-prefix and all labels in
+// --cleanup-label-selector.
+func (g *GCERunner) deleteOrphanInstances() error {
+	selector, err := parseLabelSelector(*cleanupLabelSelector)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, zone := range g.testZones() {
+		if err := g.gceComputeService.Instances.List(*project, zone).Pages(context.Background(),
+			func(ilc *compute.InstanceList) error {
+				for _, instance := range ilc.Items {
+					if !matchesCleanupFilters(instance, *cleanupNamePrefix, selector) {
+						continue
+					}
+					klog.Infof("Deleting orphaned instance %q in zone %q", instance.Name, zone)
+					if _, err := g.gceComputeService.Instances.Delete(*project, zone, instance.Name).Do(); err != nil {
+						errs = append(errs, fmt.Errorf("failed to delete orphaned instance %q: %w", instance.Name, err))
+					}
+				}
+				return nil
+			},
+		); err != nil {
+			errs = append(errs, fmt.Errorf("failed to list instances in zone %q: %w", zone, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// deleteOwnPrefixInstances deletes instances left behind by a crashed earlier
+// run of the same job, i.e. instances whose name starts with the exact
+// InstanceNamePrefix this run is about to use. Unlike deleteOrphanInstances
+// it needs no label selector, as the prefix already identifies the job.
+func (g *GCERunner) deleteOwnPrefixInstances() error {
+	prefix := g.cfg.InstanceNamePrefix
+	if prefix == "" {
+		return errors.New("--cleanup-orphans-on-start requires an instance name prefix")
+	}
+	var errs []error
+	for _, zone := range g.testZones() {
+		if err := g.gceComputeService.Instances.List(*project, zone).Pages(context.Background(),
+			func(ilc *compute.InstanceList) error {
+				for _, instance := range ilc.Items {
+					if !strings.HasPrefix(instance.Name, prefix) {
+						continue
+					}
+					klog.Infof("Deleting instance %q with our prefix %q in zone %q from an earlier run", instance.Name, prefix, zone)
+					if _, err := g.gceComputeService.Instances.Delete(*project, zone, instance.Name).Do(); err != nil {
+						errs = append(errs, fmt.Errorf("failed to delete instance %q: %w", instance.Name, err))
+					}
+				}
+				return nil
+			},
+		); err != nil {
+			errs = append(errs, fmt.Errorf("failed to list instances in zone %q: %w", zone, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (g *GCERunner) deleteGCEInstance(host string) {
+	zone := g.hostZone(host)
+	hostProject := g.hostProject(host)
+	klog.Infof("Deleting instance %q in zone %q", host, zone)
+	// Instances created with --deletion-protection cannot be deleted until
+	// the protection is cleared.
+	if *deletionProtection {
+		err := withAPIRetries(func() error {
+			_, clearErr := g.gceComputeService.Instances.SetDeletionProtection(hostProject, zone, host).DeletionProtection(false).Do()
+			return clearErr
+		})
+		if err != nil {
+			klog.Errorf("Instance %q is deletion-protected and clearing the protection failed, skipping deletion: %v", host, err)
+			return
+		}
+	}
+	var op *compute.Operation
+	err := withAPIRetries(func() error {
+		var deleteErr error
+		op, deleteErr = g.gceComputeService.Instances.Delete(hostProject, zone, host).Do()
+		return deleteErr
+	})
+	if err != nil {
+		klog.Errorf("Error deleting instance %q: %v", host, err)
+		return
+	}
+	g.recordEvent(host, "deleted")
+	gceMetrics.instancesDeleted.Inc()
+	g.forgetHost(host)
+	if !*waitForDelete {
+		return
+	}
+	var lastErr error
+	if waitErr := wait.PollUntilContextTimeout(g.pollContext(), deletePollInterval, deleteTimeout, true,
+		func(ctx context.Context) (bool, error) {
+			deleteOperation, err := g.getZoneOperation(hostProject, zone, op.Name)
+			if err != nil {
+				lastErr = err
+				return false, nil
+			}
+			if strings.ToUpper(deleteOperation.Status) != "DONE" {
+				lastErr = fmt.Errorf("instance delete operation %s not in state DONE, was %s", host, deleteOperation.Status)
+				return false, nil
+			}
+			return true, nil
+		}); waitErr != nil {
+		if lastErr != nil {
+			klog.Errorf("Error waiting for instance %q to be deleted: %v", host, lastErr)
+			return
+		}
+		klog.Errorf("Error waiting for instance %q to be deleted: %v", host, waitErr)
+	}
+}
+
+func (g *GCERunner) parseInstanceMetadata(str string) map[string]string {
+	metadata, duplicates := g.mergeInstanceMetadata(str)
+	if len(duplicates) > 0 {
+		if *strictMetadata {
+			klog.Fatalf("Duplicate instance metadata keys: %s", strings.Join(duplicates, ", "))
+		}
+		klog.Warningf("Duplicate instance metadata keys (the later value wins): %s", strings.Join(duplicates, ", "))
+	}
+	return metadata
+}
+
+// mergeInstanceMetadata parses the metadata string and merges in the
+// --node-env entries, returning the result together with any keys that were
+// set more than once. A duplicate silently loses data (the later value wins),
+// so callers surface the returned keys to the user.
+func (g *GCERunner) mergeInstanceMetadata(str string) (map[string]string, []string) {
+	metadata := make(map[string]string)
+	var duplicates []string
+	set := func(key, value string) {
+		if _, ok := metadata[key]; ok {
+			duplicates = append(duplicates, key)
+		}
+		metadata[key] = value
+	}
+	ss := strings.Split(str, ",")
+	for _, s := range ss {
+		kv := strings.Split(s, "=")
+		if len(kv) == 2 {
+			set(kv[0], kv[1])
+			continue
+		}
+		// k<<path stores the file contents base64-encoded, for binary or
+		// structured payloads that would not survive raw metadata transport.
+		// The key gets a "-b64" suffix so the guest knows to decode the value.
+		if kp := strings.SplitN(s, "<<", 2); len(kp) == 2 {
+			metaPath := kp[1]
+			if g.cfg.ImageConfigDir != "" {
+				metaPath = filepath.Join(g.cfg.ImageConfigDir, metaPath)
+			}
+			v, err := os.ReadFile(metaPath)
+			if err != nil {
+				klog.Fatalf("Failed to read metadata file %q: %v", metaPath, err)
+				continue
+			}
+			set(kp[0]+"-b64", base64.StdEncoding.EncodeToString(v))
+			continue
+		}
+		kp := strings.Split(s, "<")
+		if len(kp) != 2 {
+			klog.Fatalf("Invalid instance metadata: %q", s)
+			continue
+		}
+		metaPath := kp[1]
+		if g.cfg.ImageConfigDir != "" {
+			metaPath = filepath.Join(g.cfg.ImageConfigDir, metaPath)
+		}
+		v, err := os.ReadFile(metaPath)
+		if err != nil {
+			klog.Fatalf("Failed to read metadata file %q: %v", metaPath, err)
+			continue
+		}
+		set(kp[0], ignitionInjectGCEPublicKey(metaPath, string(v)))
+	}
+	for k, v := range nodeEnvs {
+		set(k, v)
+	}
+	return metadata, duplicates
+}
+
+// ignitionInjectGCEPublicKey tries to inject the GCE SSH public key into the
+// provided ignition file path.
+//
+// This will only being done if the job has the
+// IGNITION_INJECT_GCE_SSH_PUBLIC_KEY_FILE environment variable set, while it
+// tried to replace the GCE_SSH_PUBLIC_KEY_FILE_CONTENT placeholder.
+func ignitionInjectGCEPublicKey(path string, content string) string {
+	if os.Getenv("IGNITION_INJECT_GCE_SSH_PUBLIC_KEY_FILE") == "" {
+		return content
+	}
+	// OS Login manages keys via IAM; an injected public key would be ignored.
+	if *useOSLogin {
+		return content
+	}
+
+	klog.Infof("Injecting SSH public key into ignition")
+
+	const publicKeyEnv = "GCE_SSH_PUBLIC_KEY_FILE"
+	sshPublicKeyFile := os.Getenv(publicKeyEnv)
+	if sshPublicKeyFile == "" {
+		klog.Errorf("Environment variable %s is not set", publicKeyEnv)
+		os.Exit(1)
+	}
+
+	sshPublicKey, err := os.ReadFile(sshPublicKeyFile)
+	if err != nil {
+		klog.ErrorS(err, "unable to read SSH public key file")
+		os.Exit(1)
+	}
+
+	const sshPublicKeyFileContentMarker = "GCE_SSH_PUBLIC_KEY_FILE_CONTENT"
+	key := base64.StdEncoding.EncodeToString(sshPublicKey)
+	base64Marker := base64.StdEncoding.EncodeToString([]byte(sshPublicKeyFileContentMarker))
+	replacer := strings.NewReplacer(
+		sshPublicKeyFileContentMarker, key,
+		base64Marker, key,
+	)
+	return replacer.Replace(content)
+}
+
+// mergeGinkgoFlags appends an image's focus and skip filters to the shared
+// ginkgo flags, so different images in one config can run different test
+// subsets, e.g. benchmark configs carrying a 'tests' list.
+func mergeGinkgoFlags(base string, tests []string, skip string) string {
+	flags := base
+	if len(tests) > 0 {
+		flags += fmt.Sprintf(" --focus=%q", strings.Join(tests, "|"))
+	}
+	if skip != "" {
+		flags += fmt.Sprintf(" --skip=%q", skip)
+	}
+	return strings.TrimSpace(flags)
+}
+
+// runRemote runs the test suite on a provisioned host, replaceable in tests.
+var runRemote = remote.RunRemote
+
+// Provision a gce instance using image and run the tests in archive against the instance.
+// Delete the instance afterward.
+func (g *GCERunner) testGCEImage(suite remote.TestSuite, archivePath string, imageConfig *internalGCEImage, junitFileName string) *remote.TestResult {
+	ginkgoFlagsStr := mergeGinkgoFlags(g.cfg.GinkgoFlags, imageConfig.tests, imageConfig.skip)
+	// Time the whole run including provisioning, so boot-time regressions of
+	// an image family show up in the duration as well.
+	start := time.Now()
+	// Export the timeline once this run is fully finished, including the
+	// deferred instance deletion below.
+	defer func() {
+		if err := g.writeTimeline(); err != nil {
+			klog.Warningf("Failed to write run timeline: %v", err)
+		}
+	}()
+
+	host, err := g.createGCEInstance(imageConfig)
+	if errors.Is(err, errDryRun) {
+		return &remote.TestResult{
+			Output:   fmt.Sprintf("dry run: printed instance spec for image %s, tests skipped", imageConfig.image),
+			Skipped:  true,
+			ExitOK:   true,
+			Image:    imageConfig.image,
+			Duration: time.Since(start),
+		}
+	}
+	deleteInstance := g.shouldDeleteInstance(imageConfig)
+	if g.instanceReused(host) {
+		// Reused instances are left running for the next debug iteration.
+		deleteInstance = false
+	}
+	// keepInstance is decided once the result is known, so a failed run can
+	// keep its instance for debugging under --keep-on-failure.
+	keepInstance := false
+	if deleteInstance {
+		defer func() {
+			if keepInstance {
+				g.markHostKept(host)
+				klog.Infof("Instance %q kept for debugging (--keep-on-failure), connect with: ssh %s", host, remote.GetHostnameOrIP(host))
+				return
+			}
+			g.deleteGCEInstance(host)
+		}()
+	} else if *enableSerialConsole {
+		klog.Infof("Instance %q will be preserved, connect to its serial console with: gcloud compute connect-to-serial-port %s --zone %s --project %s",
+			host, host, imageConfig.zone, *project)
+	}
+	if err != nil {
+		return &remote.TestResult{
+			Err:      fmt.Errorf("unable to create gce instance with running docker daemon for image %s.  %v", imageConfig.image, err),
+			Image:    imageConfig.image,
+			Duration: time.Since(start),
+		}
+	}
+
+	if *collectInstanceDescribe {
+		if err := g.collectInstanceMetadata(host); err != nil {
+			klog.Warningf("Failed to collect instance metadata for %q: %v", host, err)
+		}
+	}
+
+	// Only delete the files if we are keeping the instance and want it cleaned up.
+	// If we are going to delete the instance, don't bother with cleaning up the files
+	deleteFiles := !deleteInstance && g.cfg.Cleanup
 
-	output, exitOk, err := remote.RunRemote(remote.RunRemoteConfig{
+	if err = g.registerGceHostIP(host); err != nil {
+		return &remote.TestResult{
+			Err:      err,
+			Host:     host,
+			ExitOK:   false,
+			Image:    imageConfig.image,
+			Duration: time.Since(start),
+		}
+	}
+
+	g.recordEvent(host, "test-start")
+	output, exitOk, err := runRemote(remote.RunRemoteConfig{
 		Suite:          suite,
 		Archive:        archivePath,
 		Host:           host,
@@ -488,16 +1784,42 @@ func (g *GCERunner) testGCEImage(suite remote.TestSuite, archivePath string, ima
 		ExtraEnvs:      g.cfg.ExtraEnvs,
 		RuntimeConfig:  g.cfg.RuntimeConfig,
 	})
+	g.recordEvent(host, "test-end")
+	// Collect the journal while the instance is still up; failures are
+	// tolerated since the node may already be dead.
+	if *collectJournal {
+		if jErr := g.collectJournalLog(host); jErr != nil {
+			klog.Warningf("Failed to collect journal for %q: %v", host, jErr)
+		}
+	}
 	result := remote.TestResult{
-		Output: output,
-		Err:    err,
-		Host:   host,
-		ExitOK: exitOk,
+		Output:   output,
+		Err:      err,
+		Host:     host,
+		ExitOK:   exitOk,
+		Image:    imageConfig.image,
+		Duration: time.Since(start),
+		BootTime: g.hostBootTime(host),
+	}
+	keepInstance = keepForDebugging(result.ExitOK)
+	gceMetrics.testSeconds.Observe(result.Duration.Seconds())
+	if junits, globErr := filepath.Glob(filepath.Join(remote.ResultsDir(), "junit*"+junitFileName+"*")); globErr == nil && len(junits) > 0 {
+		result.JunitPath = junits[0]
+	}
+
+	// Sample node resource usage while the instance is still up, for
+	// performance regression tracking.
+	if *sampleNodeResources {
+		if usage, err := g.sampleHostResources(host); err != nil {
+			klog.Warningf("Failed to sample node resources on %q: %v", host, err)
+		} else {
+			result.ResourceUsage = usage
+		}
 	}
 
 	// This is a temporary solution to collect serial node serial log. Only port 1 contains useful information.
 	// TODO(random-liu): Extract out and unify log collection logic with cluste e2e.
-	serialPortOutput, err := g.gceComputeService.Instances.GetSerialPortOutput(*project, *zone, host).Port(1).Do()
+	serialPortOutput, err := g.gceComputeService.Instances.GetSerialPortOutput(g.hostProject(host), g.hostZone(host), host).Port(1).Do()
 	if err != nil {
 		klog.Errorf("Failed to collect serial Output from node %q: %v", host, err)
 	} else {
@@ -507,171 +1829,1440 @@ func (g *GCERunner) testGCEImage(suite remote.TestSuite, archivePath string, ima
 			klog.Errorf("Failed to write serial Output from node %q to %q: %v", host, logFilename, err)
 		}
 	}
+
+	// Upload the collected artifacts to GCS, as the local runner disk is
+	// ephemeral in CI. Upload failures must not fail the test.
+	if *resultsGCSBucket != "" {
+		gcsPath, err := g.uploadResultsToGCS(host, imageConfig.image, junitFileName)
+		if err != nil {
+			klog.Warningf("Failed to upload results for %q to GCS: %v", host, err)
+		} else {
+			result.GCSResultsPath = gcsPath
+		}
+	}
 	return &result
 }
 
-// Provision a gce instance using image
-func (g *GCERunner) createGCEInstance(imageConfig *internalGCEImage) (string, error) {
-	p, err := g.gceComputeService.Projects.Get(*project).Do()
+// provisionedInstance is one instance recorded in the --instance-state-file,
+// carrying everything --test-from-state needs to run tests against it.
+type provisionedInstance struct {
+	Host  string `json:"host"`
+	Zone  string `json:"zone"`
+	Image string `json:"image"`
+	// ShortName is the image config key, which also names the junit file.
+	ShortName string `json:"short_name"`
+}
+
+// provisionState is the content of the --instance-state-file.
+type provisionState struct {
+	Instances []provisionedInstance `json:"instances"`
+}
+
+func writeProvisionState(path string, state *provisionState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
-		return "", fmt.Errorf("failed to get project info %q: %w", *project, err)
-	}
-	// Use default service account
-	serviceAccount := p.DefaultServiceAccount
-	klog.V(1).Infof("Creating instance %+v  with service account %q", *imageConfig, serviceAccount)
-	name := g.imageToInstanceName(imageConfig)
-	i := &compute.Instance{
-		Name:        name,
-		MachineType: g.machineType(imageConfig.machine),
-		NetworkInterfaces: []*compute.NetworkInterface{
-			{
-				AccessConfigs: []*compute.AccessConfig{
-					{
-						Type: "ONE_TO_ONE_NAT",
-						Name: "External NAT",
-					},
-				}},
-		},
-		Disks: []*compute.AttachedDisk{
-			{
-				AutoDelete: true,
-				Boot:       true,
-				Type:       "PERSISTENT",
-				InitializeParams: &compute.AttachedDiskInitializeParams{
-					SourceImage: g.sourceImage(imageConfig.image, imageConfig.project),
-					DiskSizeGb:  20,
-				},
-			},
-		},
-		ServiceAccounts: []*compute.ServiceAccount{
-			{
-				Email: serviceAccount,
-				Scopes: []string{
-					"https://www.googleapis.com/auth/cloud-platform",
-				},
-			},
-		},
+		return err
 	}
+	return os.WriteFile(path, data, 0644)
+}
 
-	scheduling := compute.Scheduling{
-		Preemptible: *preemptibleInstances,
+func readProvisionState(path string) (*provisionState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	for _, accelerator := range imageConfig.resources.Accelerators {
-		if i.GuestAccelerators == nil {
-			autoRestart := true
-			i.GuestAccelerators = []*compute.AcceleratorConfig{}
-			scheduling.OnHostMaintenance = "TERMINATE"
-			scheduling.AutomaticRestart = &autoRestart
-		}
-		aType := fmt.Sprintf(acceleratorTypeResourceFormat, *project, *zone, accelerator.Type)
-		ac := &compute.AcceleratorConfig{
-			AcceleratorCount: accelerator.Count,
-			AcceleratorType:  aType,
-		}
-		i.GuestAccelerators = append(i.GuestAccelerators, ac)
+	state := &provisionState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse instance state file %q: %w", path, err)
 	}
-	i.Scheduling = &scheduling
-	i.Metadata = imageConfig.metadata
-	var insertionOperationName string
-	if _, err := g.gceComputeService.Instances.Get(*project, *zone, i.Name).Do(); err != nil {
-		op, err := g.gceComputeService.Instances.Insert(*project, *zone, i).Do()
+	return state, nil
+}
 
-		if err != nil {
-			ret := fmt.Sprintf("could not create instance %s: API error: %v", name, err)
-			if op != nil {
-				ret = fmt.Sprintf("%s: %v", ret, op.Error)
-			}
-			return "", fmt.Errorf(ret)
-		} else if op.Error != nil {
-			var errs []string
-			for _, insertErr := range op.Error.Errors {
-				errs = append(errs, fmt.Sprintf("%+v", insertErr))
-			}
-			return "", fmt.Errorf("could not create instance %s: %+v", name, errs)
+// appendProvisionState records an instance and rewrites the state file, so a
+// partially provisioned matrix is still usable when a later instance fails.
+func (g *GCERunner) appendProvisionState(instance provisionedInstance) error {
+	g.stateMu.Lock()
+	defer g.stateMu.Unlock()
+	g.provisioned = append(g.provisioned, instance)
+	return writeProvisionState(*instanceStateFile, &provisionState{Instances: g.provisioned})
+}
 
+// provisionGCEInstance creates the instance for an image and records it to the
+// state file without running tests, for --provision-only mode.
+func (g *GCERunner) provisionGCEInstance(imageConfig *internalGCEImage, junitFileName string) *remote.TestResult {
+	start := time.Now()
+	host, err := g.createGCEInstance(imageConfig)
+	if err != nil {
+		return &remote.TestResult{
+			Err:      fmt.Errorf("unable to create gce instance with running docker daemon for image %s.  %v", imageConfig.image, err),
+			Image:    imageConfig.image,
+			Duration: time.Since(start),
 		}
-		insertionOperationName = op.Name
 	}
-	instanceRunning := false
-	var instance *compute.Instance
-	for i := 0; i < 30 && !instanceRunning; i++ {
-		if i > 0 {
-			time.Sleep(time.Second * 20)
+	// Register the external IP, so the printed SSH command works outside the
+	// instance network.
+	if err := g.registerGceHostIP(host); err != nil {
+		return &remote.TestResult{
+			Err:      err,
+			Host:     host,
+			Image:    imageConfig.image,
+			Duration: time.Since(start),
+		}
+	}
+	instance := provisionedInstance{
+		Host:      host,
+		Zone:      imageConfig.zone,
+		Image:     imageConfig.image,
+		ShortName: junitFileName,
+	}
+	if err := g.appendProvisionState(instance); err != nil {
+		return &remote.TestResult{
+			Err:      fmt.Errorf("failed to record instance %q to state file %q: %w", host, *instanceStateFile, err),
+			Host:     host,
+			Image:    imageConfig.image,
+			Duration: time.Since(start),
+		}
+	}
+	sshTarget := remote.GetHostnameOrIP(host)
+	klog.Infof("Instance %q is ready for debugging, connect with: ssh %s", host, sshTarget)
+	return &remote.TestResult{
+		Output:   fmt.Sprintf("provisioned instance %s in zone %s, deferring tests. Connect with: ssh %s", host, imageConfig.zone, sshTarget),
+		Host:     host,
+		ExitOK:   true,
+		Image:    imageConfig.image,
+		Duration: time.Since(start),
+	}
+}
+
+// testProvisionedInstance runs the tests against an instance recorded in the
+// state file by an earlier --provision-only run.
+func (g *GCERunner) testProvisionedInstance(suite remote.TestSuite, archivePath string, instance provisionedInstance) *remote.TestResult {
+	start := time.Now()
+	g.recordHostZone(instance.Host, instance.Zone)
+	if err := g.registerGceHostIP(instance.Host); err != nil {
+		return &remote.TestResult{
+			Err:      err,
+			Host:     instance.Host,
+			ExitOK:   false,
+			Image:    instance.Image,
+			Duration: time.Since(start),
+		}
+	}
+	output, exitOk, err := runRemote(remote.RunRemoteConfig{
+		Suite:          suite,
+		Archive:        archivePath,
+		Host:           instance.Host,
+		Cleanup:        g.cfg.Cleanup,
+		ImageDesc:      instance.Image,
+		JunitFileName:  instance.ShortName,
+		TestArgs:       g.cfg.TestArgs,
+		GinkgoArgs:     g.cfg.GinkgoFlags,
+		SystemSpecName: g.cfg.SystemSpecName,
+		ExtraEnvs:      g.cfg.ExtraEnvs,
+		RuntimeConfig:  g.cfg.RuntimeConfig,
+	})
+	return &remote.TestResult{
+		Output:   output,
+		Err:      err,
+		Host:     instance.Host,
+		ExitOK:   exitOk,
+		Image:    instance.Image,
+		Duration: time.Since(start),
+	}
+}
+
+// secretMetadataKeyRe matches metadata keys that may carry secrets and must
+// be redacted from the instance-metadata artifact.
+var secretMetadataKeyRe = regexp.MustCompile(`(?i)key|token|secret|password|credential`)
+
+// redactedMetadataValue replaces the value of secret-looking metadata keys.
+const redactedMetadataValue = "<redacted>"
+
+// instanceMetadataArtifact renders the instance's effective metadata as JSON,
+// redacting secret-looking keys.
+func instanceMetadataArtifact(metadata *compute.Metadata) (string, error) {
+	items := map[string]string{}
+	if metadata != nil {
+		for _, item := range metadata.Items {
+			value := ""
+			if item.Value != nil {
+				value = *item.Value
+			}
+			if secretMetadataKeyRe.MatchString(item.Key) {
+				value = redactedMetadataValue
+			}
+			items[item.Key] = value
 		}
-		var insertionOperation *compute.Operation
-		insertionOperation, err = g.gceComputeService.ZoneOperations.Get(*project, *zone, insertionOperationName).Do()
+	}
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// collectInstanceMetadata writes the metadata the instance actually received
+// to instance-metadata.json in the artifacts for the host, to confirm it
+// matches what was intended.
+func (g *GCERunner) collectInstanceMetadata(host string) error {
+	instance, err := g.gceComputeService.Instances.Get(g.hostProject(host), g.hostZone(host), host).Do()
+	if err != nil {
+		return err
+	}
+	content, err := instanceMetadataArtifact(instance.Metadata)
+	if err != nil {
+		return err
+	}
+	return remote.WriteLog(host, "instance-metadata.json", content)
+}
+
+// storageClient returns a GCS client authenticated the same way as the
+// compute client.
+func (g *GCERunner) storageClient(ctx context.Context) (*storage.Client, error) {
+	if *impersonateServiceAccount != "" || *gcpCredentialsFile != "" {
+		opts, err := computeServiceOptions()
 		if err != nil {
-			continue
+			return nil, err
+		}
+		return storage.NewClient(ctx, opts...)
+	}
+	return storage.NewClient(ctx)
+}
+
+// uploadResultsToGCS uploads the serial logs and junit files collected for
+// the given host to gs://<results-gcs-bucket>/<instance-name-prefix>/<image>/
+// and returns that path.
+func (g *GCERunner) uploadResultsToGCS(host, image, junitFileName string) (string, error) {
+	ctx := context.Background()
+	client, err := g.storageClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create storage client: %w", err)
+	}
+	defer client.Close()
+
+	var files []string
+	if logs, err := filepath.Glob(filepath.Join(remote.ResultsDir(), host, "*.log")); err == nil {
+		files = append(files, logs...)
+	}
+	if junits, err := filepath.Glob(filepath.Join(remote.ResultsDir(), "junit*"+junitFileName+"*")); err == nil {
+		files = append(files, junits...)
+	}
+
+	prefix := path.Join(g.cfg.InstanceNamePrefix, image)
+	for _, file := range files {
+		object := path.Join(prefix, filepath.Base(file))
+		if err := uploadFileToGCS(ctx, client, *resultsGCSBucket, object, file); err != nil {
+			return "", fmt.Errorf("failed to upload %q to gs://%s/%s: %w", file, *resultsGCSBucket, object, err)
+		}
+	}
+	return fmt.Sprintf("gs://%s/%s/", *resultsGCSBucket, prefix), nil
+}
+
+func uploadFileToGCS(ctx context.Context, client *storage.Client, bucket, object, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	w := client.Bucket(bucket).Object(object).NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Provision a gce instance using image, falling back to the next configured
+// zone when the preferred one is out of capacity for the machine type.
+func (g *GCERunner) createGCEInstance(imageConfig *internalGCEImage) (string, error) {
+	candidates := g.testZones()
+	// Rotate the candidates so the round-robin zone is attempted first.
+	first := g.pickZone()
+	for i, z := range candidates {
+		if z == first {
+			candidates = append(candidates[i:], candidates[:i]...)
+			break
+		}
+	}
+
+	start := time.Now()
+	var errs []error
+	var name string
+	for _, z := range candidates {
+		imageConfig.zone = z
+		var err error
+		name, err = g.createGCEInstanceInZone(imageConfig)
+		if err == nil {
+			gceMetrics.instancesCreated.Inc()
+			gceMetrics.provisioningSeconds.Observe(time.Since(start).Seconds())
+			return name, nil
+		}
+		errs = append(errs, fmt.Errorf("zone %q: %w", z, err))
+		if !isZoneStockout(err) {
+			break
 		}
-		if strings.ToUpper(insertionOperation.Status) != "DONE" {
-			err = fmt.Errorf("instance insert operation %s not in state DONE, was %s", name, insertionOperation.Status)
+		klog.Warningf("Zone %q is out of capacity for image %q, trying next zone", z, imageConfig.image)
+	}
+	// A dry run is not a failure, everything else here is.
+	if agg := utilerrors.NewAggregate(errs); !errors.Is(agg, errDryRun) {
+		gceMetrics.creationFailures.Inc()
+	}
+	return name, utilerrors.NewAggregate(errs)
+}
+
+// errDryRun marks provisioning that was skipped because of --dry-run.
+var errDryRun = errors.New("dry run requested, instance not created")
+
+// quotaMessageRe extracts the metric, limit and region from a GCE
+// quota-exceeded message of the form
+// "Quota 'CPUS' exceeded.  Limit: 24.0 in region europe-west1.".
+var quotaMessageRe = regexp.MustCompile(`Quota '([A-Z0-9_]+)' exceeded\.\s+Limit: ([0-9.]+)(?: in region ([a-z0-9-]+))?`)
+
+// quotaError converts a quota-exceeded insert failure into an actionable
+// error naming the exhausted metric and region, so operators know whether to
+// raise CPU, in-use IP or GPU quota. Returns nil for non-quota errors.
+func quotaError(err error) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return nil
+	}
+	for _, e := range apiErr.Errors {
+		if e.Reason != "quotaExceeded" {
 			continue
 		}
-		if insertionOperation.Error != nil {
-			var errs []string
-			for _, insertErr := range insertionOperation.Error.Errors {
-				errs = append(errs, fmt.Sprintf("%+v", insertErr))
+		if m := quotaMessageRe.FindStringSubmatch(e.Message); m != nil {
+			if m[3] == "" {
+				return fmt.Errorf("exceeded %s quota (limit %s)", m[1], m[2])
 			}
-			return name, fmt.Errorf("could not create instance %s: %+v", name, errs)
+			return fmt.Errorf("exceeded %s quota in region %s (limit %s)", m[1], m[3], m[2])
 		}
+		return fmt.Errorf("exceeded quota: %s", e.Message)
+	}
+	return nil
+}
 
-		instance, err = g.gceComputeService.Instances.Get(*project, *zone, name).Do()
+// insertError wraps an instance insert failure with the operation error and
+// configuration hints. The underlying error is wrapped so errors.Is/errors.As
+// keep working, and API error text is never used as a format string since it
+// may contain literal '%' characters.
+func insertError(name string, err error, op *compute.Operation) error {
+	if quotaErr := quotaError(err); quotaErr != nil {
+		return fmt.Errorf("could not create instance %s: %w", name, quotaErr)
+	}
+	details := ""
+	if op != nil {
+		details = fmt.Sprintf(": %v", op.Error)
+	}
+	if *stackType == stackTypeDualStack {
+		details += fmt.Sprintf(" (note: --stack-type=%s requires a dual-stack subnetwork)", stackTypeDualStack)
+	}
+	if *enableNestedVirtualization {
+		details += " (note: --enable-nested-virtualization requires a Haswell or newer Intel CPU platform)"
+	}
+	return fmt.Errorf("could not create instance %s: API error: %w%s", name, err, details)
+}
+
+// isZoneStockout reports whether the error indicates the zone is out of
+// capacity for the requested machine type. Quota errors are deliberately not
+// treated as stockouts, as they would fail in every zone of the project.
+func isZoneStockout(err error) bool {
+	return strings.Contains(err.Error(), "ZONE_RESOURCE_POOL_EXHAUSTED")
+}
+
+// createGCEInstanceInZone provisions a gce instance using image in the zone
+// set on imageConfig.
+func (g *GCERunner) createGCEInstanceInZone(imageConfig *internalGCEImage) (string, error) {
+	launchProject := g.launchProject(imageConfig)
+	p, err := g.gceComputeService.Projects.Get(launchProject).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get project info %q: %w", launchProject, err)
+	}
+	if err := g.validateAccelerators(imageConfig); err != nil {
+		return "", err
+	}
+	serviceAccounts := g.instanceServiceAccounts(imageConfig, p.DefaultServiceAccount)
+	klog.V(1).Infof("Creating instance %+v in zone %q of project %q with service account %q", *imageConfig, imageConfig.zone, launchProject, serviceAccounts[0].Email)
+	name := g.imageToInstanceName(imageConfig)
+	g.recordHostZone(name, imageConfig.zone)
+	g.recordHostProject(name, launchProject)
+	// Record the per-image keep decision as soon as the host is tracked, so a
+	// shutdown signal arriving mid-provisioning already honors it.
+	if !g.shouldDeleteInstance(imageConfig) {
+		g.markHostKept(name)
+	}
+	// Register the per-image SSH user before the first SSH attempt, so every
+	// later call (daemon check, cloud-init, kernel args, reboot) picks it up.
+	if imageConfig.sshUser != "" {
+		remote.AddSSHUser(name, imageConfig.sshUser)
+	}
+	i := &compute.Instance{
+		Name:               name,
+		MachineType:        g.machineType(imageConfig.zone, imageConfig.machine),
+		NetworkInterfaces:  []*compute.NetworkInterface{instanceNetworkInterface()},
+		Disks:              g.instanceDisks(imageConfig),
+		ServiceAccounts:    serviceAccounts,
+		DeletionProtection: *deletionProtection,
+	}
+	// A regional boot disk cannot be initialized from an image inline, so it
+	// is created up front and attached by source.
+	if *regionalDisk {
+		source, err := g.createRegionalBootDisk(name, imageConfig)
 		if err != nil {
-			continue
+			return "", err
 		}
-		if strings.ToUpper(instance.Status) != "RUNNING" {
-			err = fmt.Errorf("instance %s not in state RUNNING, was %s", name, instance.Status)
-			continue
+		i.Disks[0].InitializeParams = nil
+		i.Disks[0].Source = source
+	}
+	if *enableGvnic {
+		if g.imageSupportsGVNIC(imageConfig) {
+			i.NetworkInterfaces[0].NicType = "GVNIC"
+		} else {
+			klog.Warningf("Image %q does not advertise the GVNIC guest-os-feature, falling back to VirtIO", imageConfig.image)
+		}
+	}
+	perfConfig, err := networkPerformanceConfig(i.MachineType)
+	if err != nil {
+		return "", err
+	}
+	i.NetworkPerformanceConfig = perfConfig
+
+	scheduling := compute.Scheduling{
+		Preemptible: *preemptibleInstances,
+	}
+	for _, accelerator := range imageConfig.resources.Accelerators {
+		if i.GuestAccelerators == nil {
+			autoRestart := true
+			i.GuestAccelerators = []*compute.AcceleratorConfig{}
+			scheduling.OnHostMaintenance = "TERMINATE"
+			scheduling.AutomaticRestart = &autoRestart
+		}
+		aType := g.acceleratorType(imageConfig, accelerator.Type)
+		ac := &compute.AcceleratorConfig{
+			AcceleratorCount: accelerator.Count,
+			AcceleratorType:  aType,
 		}
-		externalIP := g.getExternalIP(instance)
-		if len(externalIP) > 0 {
-			remote.AddHostnameIP(name, externalIP)
+		i.GuestAccelerators = append(i.GuestAccelerators, ac)
+	}
+	applyOnHostMaintenance(&scheduling)
+	applyAutomaticRestart(&scheduling)
+	applyNodeAffinities(&scheduling)
+	i.Scheduling = &scheduling
+	if err := applyConfidentialCompute(i); err != nil {
+		return "", err
+	}
+	i.MinCpuPlatform = *minCPUPlatform
+	applyAdvancedMachineFeatures(i)
+	reservation, err := parseReservationAffinity(*reservationAffinity)
+	if err != nil {
+		return "", err
+	}
+	i.ReservationAffinity = reservation
+	// Work on a copy of the image metadata: the helpers below append to it,
+	// and the shared original must stay untouched for zone-fallback retries
+	// and the other machines-expansion entries of this image.
+	i.Metadata = cloneMetadata(imageConfig.metadata)
+	if *injectReadinessScript {
+		i.Metadata = addReadinessMetadata(i.Metadata)
+	}
+	if *enableSerialConsole {
+		i.Metadata = addSerialConsoleMetadata(i.Metadata)
+	}
+	if *enableOpsAgent {
+		i.Metadata = addOpsAgentMetadata(i.Metadata)
+	}
+	if *useOSLogin {
+		i.Metadata = addOSLoginMetadata(i.Metadata)
+		if user := osLoginUsername(*osLoginEmail); user != "" {
+			remote.AddSSHUser(name, user)
 		}
+	}
+	i.Metadata = addSSHKeysMetadata(i.Metadata)
+	applyBuildID(i)
+	// Label the boot disk so cost tooling can attribute disk spend separately
+	// from instance spend. Left unset when there are no labels to apply.
+	if labels, err := bootDiskLabels(i.Labels); err != nil {
+		return "", err
+	} else if len(labels) > 0 && i.Disks[0].InitializeParams != nil {
+		i.Disks[0].InitializeParams.Labels = labels
+	}
+	// In dry-run mode print the fully assembled spec instead of submitting it,
+	// so config files can be debugged without spending quota.
+	if *dryRun {
+		spec, err := json.MarshalIndent(i, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("Dry run: would create instance in zone %s:\n%s\n", imageConfig.zone, spec)
+		return name, errDryRun
+	}
+	var insertionOperationName string
+	var existing *compute.Instance
+	getErr := withAPIRetries(func() error {
+		var err error
+		existing, err = g.gceComputeService.Instances.Get(launchProject, imageConfig.zone, i.Name).Do()
+		return err
+	})
+	if getErr == nil {
+		if *reuseInstances && strings.ToUpper(existing.Status) == "RUNNING" {
+			klog.Infof("Reusing existing instance %q in zone %q", name, imageConfig.zone)
+			g.markInstanceReused(name)
+		}
+	} else {
+		var op *compute.Operation
+		err := withAPIRetries(func() error {
+			var insertErr error
+			op, insertErr = g.gceComputeService.Instances.Insert(launchProject, imageConfig.zone, i).Do()
+			return insertErr
+		})
 
-		var output string
-		output, err = remote.SSH(name, "sh", "-c",
-			"'systemctl list-units  --type=service  --state=running | grep -e containerd -e crio'")
 		if err != nil {
-			err = fmt.Errorf("instance %s not running containerd/crio daemon - Command failed: %s", name, output)
+			return "", insertError(name, err, op)
+		} else if op.Error != nil {
+			var errs []string
+			for _, insertErr := range op.Error.Errors {
+				errs = append(errs, fmt.Sprintf("%+v", insertErr))
+			}
+			return "", fmt.Errorf("could not create instance %s: %+v", name, errs)
+
+		}
+		insertionOperationName = op.Name
+		g.recordEvent(name, "insert-issued")
+	}
+	// Stream the serial console while waiting for the instance, so boot
+	// hangs are visible before the provisioning timeout expires.
+	if *streamSerial {
+		streamCtx, stopStreaming := context.WithCancel(g.pollContext())
+		defer stopStreaming()
+		go g.streamSerialOutput(streamCtx, name, imageConfig.zone)
+	}
+	var instance *compute.Instance
+	instance, err = g.waitForInstanceUp(name, imageConfig.zone, insertionOperationName)
+	// If instance didn't reach running state in time, return with error now.
+	if err != nil {
+		return name, err
+	}
+	// Instance reached running state in time, make sure that the startup
+	// sequence is complete
+	if *injectReadinessScript {
+		err = g.waitForReadinessAttribute(name, imageConfig.zone)
+		if err != nil {
+			return name, err
+		}
+	} else if g.isCloudInitUsed(imageConfig.metadata) {
+		err = g.waitForCloudInit(name)
+		if err != nil {
+			return name, err
+		}
+	}
+
+	// Copy injected files onto the node before handing it off to the suite.
+	if err := g.injectFiles(name); err != nil {
+		return name, err
+	}
+
+	// Install GPU drivers on instances with accelerators attached, so GPU
+	// device-plugin tests don't start against bare GPUs.
+	if *installGPUDrivers {
+		if err := g.installGPUDrivers(name, imageConfig); err != nil {
+			return name, err
+		}
+	}
+
+	// apply additional kernel arguments to the instance
+	if len(imageConfig.kernelArguments) > 0 {
+		klog.Info("Update kernel arguments")
+		if err := g.updateKernelArguments(instance, imageConfig.image, imageConfig.kernelArguments); err != nil {
+			return name, err
+		}
+	}
+
+	// Run the preflight script last, so it sees the fully provisioned node.
+	if err := g.runPreflightScript(name); err != nil {
+		return name, err
+	}
+
+	return name, err
+}
+
+// provisionBackoff returns the backoff for the instance-running poll. It
+// starts faster than the fixed provisionPollInterval of the other poll loops,
+// grows up to it and jitters every step, so instances provisioned in parallel
+// don't hit the GCE API in lockstep. Steps is sized generously for the given
+// total budget; the poll context enforces the hard cutoff.
+func provisionBackoff(total time.Duration) wait.Backoff {
+	steps := int(total/provisionPollInterval) + 3
+	return wait.Backoff{
+		Duration: 5 * time.Second,
+		Factor:   1.5,
+		Jitter:   0.2,
+		Cap:      provisionPollInterval,
+		Steps:    steps,
+	}
+}
+
+// waitForInstanceUp polls until the insert operation finished, the instance
+// reached RUNNING state and a containerd/crio daemon is running on it, or
+// --instance-up-timeout expired.
+func (g *GCERunner) waitForInstanceUp(name, zone, insertionOperationName string) (*compute.Instance, error) {
+	var instance *compute.Instance
+	var lastErr error
+	delayed := false
+	ctx, cancel := context.WithTimeout(g.pollContext(), *instanceUpTimeout)
+	defer cancel()
+	if waitErr := wait.ExponentialBackoffWithContext(ctx, provisionBackoff(*instanceUpTimeout),
+		func(ctx context.Context) (bool, error) {
+			// An empty operation name means the instance already existed and
+			// no insert was issued, so there is no operation to wait for.
+			if insertionOperationName != "" {
+				insertionOperation, err := g.getZoneOperation(g.hostProject(name), zone, insertionOperationName)
+				if err != nil {
+					lastErr = err
+					return false, nil
+				}
+				if strings.ToUpper(insertionOperation.Status) != "DONE" {
+					lastErr = fmt.Errorf("instance insert operation %s not in state DONE, was %s", name, insertionOperation.Status)
+					return false, nil
+				}
+				if insertionOperation.Error != nil {
+					var errs []string
+					for _, insertErr := range insertionOperation.Error.Errors {
+						errs = append(errs, fmt.Sprintf("%+v", insertErr))
+					}
+					// Terminal: drop any transient error from a previous
+					// iteration so the operation error (e.g. a stockout the
+					// zone fallback keys on) is what gets returned.
+					lastErr = nil
+					return false, fmt.Errorf("could not create instance %s: %+v", name, errs)
+				}
+				if *measureBootTime {
+					g.markInstanceBooting(name)
+				}
+			}
+
+			var err error
+			instance, err = g.gceComputeService.Instances.Get(g.hostProject(name), zone, name).Do()
+			if err != nil {
+				lastErr = err
+				return false, nil
+			}
+			if strings.ToUpper(instance.Status) != "RUNNING" {
+				lastErr = fmt.Errorf("instance %s not in state RUNNING, was %s", name, instance.Status)
+				return false, nil
+			}
+			externalIP := g.getExternalIP(instance)
+			if len(externalIP) > 0 {
+				remote.AddHostnameIP(name, externalIP)
+			}
+
+			// sshd is rarely up the moment the instance reaches RUNNING, so
+			// give it a head start instead of burning SSH attempts.
+			if !delayed {
+				delayed = true
+				g.recordEvent(name, "running")
+				if *initialReadinessDelay > 0 {
+					klog.V(2).Infof("Instance %s is running, waiting %v before the first SSH readiness attempt", name, *initialReadinessDelay)
+					readinessSleep(*initialReadinessDelay)
+				}
+			}
+
+			if err := g.checkDaemonRunning(name); err != nil {
+				lastErr = err
+				if *useOSLogin {
+					lastErr = fmt.Errorf("%v (note: OS Login requires roles/compute.osLogin on the connecting identity, and roles/iam.serviceAccountUser when the instance runs as a service account)", lastErr)
+				}
+				return false, nil
+			}
+			if *measureBootTime {
+				g.markInstanceBooted(name)
+			}
+			g.recordEvent(name, "ssh-ready")
+			return true, nil
+		}); waitErr != nil {
+		if lastErr != nil {
+			return instance, lastErr
+		}
+		return instance, waitErr
+	}
+	return instance, nil
+}
+
+// daemonCheckSSHAttempts bounds how often a single poll iteration retries the
+// daemon check when SSH itself cannot reach the instance yet.
+const daemonCheckSSHAttempts = 3
+
+// errSSHAttemptTimeout marks a daemon-check SSH attempt that exceeded
+// --ssh-timeout before returning.
+var errSSHAttemptTimeout = errors.New("ssh attempt timed out")
+
+// runtimeServiceNames returns the systemd service names the daemon check
+// accepts, parsed from --runtime-service-name.
+func runtimeServiceNames() []string {
+	var names []string
+	for _, name := range strings.Split(*runtimeServiceName, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// daemonCheckSSH runs the runtime daemon check over SSH, bounding the
+// attempt with --ssh-timeout so a hung connection doesn't stall the whole
+// provisioning poll iteration.
+func (g *GCERunner) daemonCheckSSH(name string) (string, error) {
+	type sshResult struct {
+		output string
+		err    error
+	}
+	greps := make([]string, 0, len(runtimeServiceNames()))
+	for _, service := range runtimeServiceNames() {
+		greps = append(greps, "-e "+service)
+	}
+	check := fmt.Sprintf("'systemctl list-units  --type=service  --state=running | grep %s'", strings.Join(greps, " "))
+	if *skipRuntimeCheck {
+		// Only confirm SSH works; the test is expected to bring up the
+		// runtime itself.
+		check = "'true'"
+	}
+	ch := make(chan sshResult, 1)
+	go func() {
+		output, err := instanceUpSSH(name, "sh", "-c", check)
+		ch <- sshResult{output, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.output, r.err
+	case <-time.After(*sshTimeout):
+		return "", fmt.Errorf("%w after %v", errSSHAttemptTimeout, *sshTimeout)
+	}
+}
+
+// sshUnreachable reports whether a failed SSH attempt never reached the
+// instance, as opposed to reaching it and finding no daemon.
+func sshUnreachable(output string, err error) bool {
+	if errors.Is(err, errSSHAttemptTimeout) {
+		return true
+	}
+	for _, marker := range []string{
+		"Connection refused",
+		"Connection timed out",
+		"Connection closed by",
+		"No route to host",
+		"ssh: connect to host",
+		"kex_exchange_identification",
+	} {
+		if strings.Contains(output, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDaemonRunning verifies one of the --runtime-service-name daemons is
+// running on the instance, or only that SSH is reachable when
+// --skip-runtime-check is set. SSH connection failures are retried up to
+// daemonCheckSSHAttempts times and reported as the instance not being
+// reachable yet, so a slow sshd is not misdiagnosed as a missing daemon.
+func (g *GCERunner) checkDaemonRunning(name string) error {
+	var output string
+	var err error
+	for attempt := 0; attempt < daemonCheckSSHAttempts; attempt++ {
+		output, err = g.daemonCheckSSH(name)
+		if err == nil {
+			break
+		}
+		if !sshUnreachable(output, err) {
+			// SSH reached the instance; retrying won't change the answer.
+			break
+		}
+	}
+	services := runtimeServiceNames()
+	if err != nil {
+		if sshUnreachable(output, err) {
+			return fmt.Errorf("instance %s not reachable over SSH yet: %v", name, err)
+		}
+		return fmt.Errorf("instance %s not running %s daemon - Command failed: %s", name, strings.Join(services, "/"), output)
+	}
+	if *skipRuntimeCheck {
+		return nil
+	}
+	for _, service := range services {
+		if strings.Contains(output, service+".service") {
+			return nil
+		}
+	}
+	return fmt.Errorf("instance %s not running %s daemon: %s", name, strings.Join(services, "/"), output)
+}
+
+// getZoneOperation fetches a zone operation, retrying transient errors with
+// exponential backoff so they don't burn iterations of the surrounding
+// provisioning poll.
+func (g *GCERunner) getZoneOperation(project, zone, name string) (*compute.Operation, error) {
+	backoff := wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Steps:    *zoneOperationRetries,
+	}
+
+	var op *compute.Operation
+	var lastErr error
+	if waitErr := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		op, lastErr = g.gceComputeService.ZoneOperations.Get(project, zone, name).Do()
+		return lastErr == nil, nil
+	}); waitErr != nil {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, waitErr
+	}
+	return op, nil
+}
+
+// waitForCloudInit polls until the cloud-init script finished on the instance
+// or --cloud-init-timeout expired.
+func (g *GCERunner) waitForCloudInit(name string) error {
+	var lastErr error
+	if waitErr := wait.PollUntilContextTimeout(g.pollContext(), provisionPollInterval, *cloudInitTimeout, true,
+		func(ctx context.Context) (bool, error) {
+			finished, err := remote.SSH(name, "ls", "/var/lib/cloud/instance/boot-finished")
+			if err != nil {
+				lastErr = fmt.Errorf("instance %s has not finished cloud-init script: %s", name, finished)
+				return false, nil
+			}
+			return true, nil
+		}); waitErr != nil {
+		if lastErr != nil {
+			return lastErr
+		}
+		return waitErr
+	}
+	g.recordEvent(name, "cloud-init-done")
+	return nil
+}
+
+// cloneMetadata returns a deep copy of the given metadata, so the add*Metadata
+// helpers and applyBuildID can append to one instance's metadata without
+// mutating the shared per-image original.
+func cloneMetadata(metadata *compute.Metadata) *compute.Metadata {
+	if metadata == nil {
+		return nil
+	}
+	clone := *metadata
+	clone.Items = make([]*compute.MetadataItems, 0, len(metadata.Items))
+	for _, item := range metadata.Items {
+		itemCopy := *item
+		if item.Value != nil {
+			value := *item.Value
+			itemCopy.Value = &value
+		}
+		clone.Items = append(clone.Items, &itemCopy)
+	}
+	return &clone
+}
+
+// addReadinessMetadata injects the readiness startup-script into the given
+// metadata and enables guest attributes so the script can write its status.
+func addReadinessMetadata(metadata *compute.Metadata) *compute.Metadata {
+	if metadata == nil {
+		metadata = &compute.Metadata{}
+	}
+	script := readinessStartupScript
+	enabled := "TRUE"
+	metadata.Items = append(metadata.Items,
+		&compute.MetadataItems{
+			Key:   "startup-script",
+			Value: &script,
+		},
+		&compute.MetadataItems{
+			Key:   "enable-guest-attributes",
+			Value: &enabled,
+		},
+	)
+	return metadata
+}
+
+// addOSLoginMetadata enables OS Login on the instance, replacing
+// metadata-based SSH keys with IAM-managed access.
+func addOSLoginMetadata(metadata *compute.Metadata) *compute.Metadata {
+	if metadata == nil {
+		metadata = &compute.Metadata{}
+	}
+	enabled := "TRUE"
+	metadata.Items = append(metadata.Items, &compute.MetadataItems{
+		Key:   "enable-oslogin",
+		Value: &enabled,
+	})
+	return metadata
+}
+
+// osLoginUsername derives the OS Login-managed username from an identity
+// email, e.g. user@example.com becomes user_example_com. Service accounts map
+// to sa_<unique id>, which cannot be derived locally.
+func osLoginUsername(email string) string {
+	if email == "" {
+		return ""
+	}
+	return strings.NewReplacer("@", "_", ".", "_", "-", "_").Replace(strings.ToLower(email))
+}
+
+// addSSHKeysMetadata appends an ssh-keys metadata entry of the form
+// <user>:<key> read from GCE_SSH_PUBLIC_KEY_FILE, so SSH works on images
+// without an ignition injection path (e.g. COS, Ubuntu). The entry is not
+// duplicated when already present.
+func addSSHKeysMetadata(metadata *compute.Metadata) *compute.Metadata {
+	keyFile := os.Getenv("GCE_SSH_PUBLIC_KEY_FILE")
+	if keyFile == "" || *useOSLogin {
+		return metadata
+	}
+	// Ignition images get the key injected into their ignition config instead.
+	if os.Getenv("IGNITION_INJECT_GCE_SSH_PUBLIC_KEY_FILE") != "" {
+		return metadata
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		klog.Warningf("Failed to read GCE_SSH_PUBLIC_KEY_FILE %q: %v", keyFile, err)
+		return metadata
+	}
+	user := remote.GetSSHUser()
+	if user == "" {
+		klog.Warning("No SSH user configured, not injecting ssh-keys metadata")
+		return metadata
+	}
+	entry := fmt.Sprintf("%s:%s", user, strings.TrimSpace(string(key)))
+	if metadata == nil {
+		metadata = &compute.Metadata{}
+	}
+	for _, item := range metadata.Items {
+		if item.Key != "ssh-keys" {
 			continue
 		}
-		if !strings.Contains(output, "containerd.service") &&
-			!strings.Contains(output, "crio.service") {
-			err = fmt.Errorf("instance %s not running containerd/crio daemon: %s", name, output)
+		if item.Value != nil && strings.Contains(*item.Value, entry) {
+			return metadata
+		}
+		value := entry
+		if item.Value != nil && *item.Value != "" {
+			value = *item.Value + "\n" + entry
+		}
+		item.Value = &value
+		return metadata
+	}
+	metadata.Items = append(metadata.Items, &compute.MetadataItems{
+		Key:   "ssh-keys",
+		Value: &entry,
+	})
+	return metadata
+}
+
+// addSerialConsoleMetadata enables interactive serial-console access on the
+// instance.
+func addSerialConsoleMetadata(metadata *compute.Metadata) *compute.Metadata {
+	if metadata == nil {
+		metadata = &compute.Metadata{}
+	}
+	enabled := "TRUE"
+	metadata.Items = append(metadata.Items, &compute.MetadataItems{
+		Key:   "serial-port-enable",
+		Value: &enabled,
+	})
+	return metadata
+}
+
+// addOpsAgentMetadata enables the built-in Cloud Logging and Monitoring
+// agents on the instance via the google-logging-enabled and
+// google-monitoring-enabled metadata keys. Existing items, including any
+// user-data or startup-script, are left untouched, and values the config
+// already sets for these keys win.
+func addOpsAgentMetadata(metadata *compute.Metadata) *compute.Metadata {
+	if metadata == nil {
+		metadata = &compute.Metadata{}
+	}
+	existing := make(map[string]bool, len(metadata.Items))
+	for _, item := range metadata.Items {
+		existing[item.Key] = true
+	}
+	for _, key := range []string{"google-logging-enabled", "google-monitoring-enabled"} {
+		if existing[key] {
 			continue
 		}
-		instanceRunning = true
+		enabled := "true"
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{
+			Key:   key,
+			Value: &enabled,
+		})
+	}
+	return metadata
+}
+
+// waitForReadinessAttribute polls the startup/status guest attribute written
+// by the injected readiness startup-script until it signals completion or
+// --cloud-init-timeout expired.
+func (g *GCERunner) waitForReadinessAttribute(name, zone string) error {
+	var lastErr error
+	if waitErr := wait.PollUntilContextTimeout(g.pollContext(), provisionPollInterval, *cloudInitTimeout, true,
+		func(ctx context.Context) (bool, error) {
+			attr, err := g.gceComputeService.Instances.GetGuestAttributes(g.hostProject(name), zone, name).
+				VariableKey(readinessAttributePath).Do()
+			if err != nil {
+				lastErr = fmt.Errorf("instance %s has not written the %s guest attribute yet: %w", name, readinessAttributePath, err)
+				return false, nil
+			}
+			if attr.VariableValue != readinessAttributeDone {
+				lastErr = fmt.Errorf("instance %s startup not complete, %s guest attribute was %q", name, readinessAttributePath, attr.VariableValue)
+				return false, nil
+			}
+			return true, nil
+		}); waitErr != nil {
+		if lastErr != nil {
+			return lastErr
+		}
+		return waitErr
+	}
+	return nil
+}
+
+// confidentialComputeMachineFamilies are the machine families supporting
+// Confidential VM.
+var confidentialComputeMachineFamilies = []string{"n2d-", "c2d-"}
+
+// applyConfidentialCompute enables Confidential VM on the instance when
+// --confidential-compute is set, forcing on-host-maintenance TERMINATE as GCE
+// requires, or errors when the machine family does not support it.
+func applyConfidentialCompute(i *compute.Instance) error {
+	if !*confidentialCompute {
+		return nil
+	}
+	// The machine type is a machine-type path or URL; only the final component
+	// carries the family.
+	machine := i.MachineType
+	if idx := strings.LastIndex(machine, "/"); idx >= 0 {
+		machine = machine[idx+1:]
+	}
+	supported := false
+	for _, family := range confidentialComputeMachineFamilies {
+		if strings.HasPrefix(machine, family) {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return fmt.Errorf("machine type %q does not support Confidential VM, use one of the %v machine families", machine, confidentialComputeMachineFamilies)
+	}
+	i.ConfidentialInstanceConfig = &compute.ConfidentialInstanceConfig{EnableConfidentialCompute: true}
+	if i.Scheduling == nil {
+		i.Scheduling = &compute.Scheduling{}
+	}
+	i.Scheduling.OnHostMaintenance = "TERMINATE"
+	return nil
+}
+
+// applyOnHostMaintenance sets the requested --on-host-maintenance policy on
+// the scheduling block. Instances with accelerators cannot live-migrate, so
+// an already-forced TERMINATE always wins over a requested MIGRATE.
+func applyOnHostMaintenance(scheduling *compute.Scheduling) {
+	if *onHostMaintenance == "" {
+		return
+	}
+	if scheduling.OnHostMaintenance == "TERMINATE" {
+		if *onHostMaintenance == "MIGRATE" {
+			klog.Warningf("Ignoring --on-host-maintenance=MIGRATE: the instance configuration forces TERMINATE")
+		}
+		return
+	}
+	scheduling.OnHostMaintenance = *onHostMaintenance
+}
+
+// applyAutomaticRestart applies --automatic-restart to the scheduling block.
+// Preemptible instances cannot restart automatically and GCE rejects the
+// combination, so the flag is ignored with a warning there.
+func applyAutomaticRestart(scheduling *compute.Scheduling) {
+	if *automaticRestart == "" {
+		return
+	}
+	restart := *automaticRestart == "true"
+	if scheduling.Preemptible {
+		if restart {
+			klog.Warningf("Ignoring --automatic-restart=true: preemptible instances cannot restart automatically")
+		}
+		return
+	}
+	scheduling.AutomaticRestart = &restart
+}
+
+// isRetryableAPIError reports whether the compute API error is transient,
+// i.e. a server-side 5xx or rate-limit error. 4xx errors such as quota,
+// not-found or permission failures are permanent and never retried.
+func isRetryableAPIError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	// Quota errors won't resolve within a retry budget regardless of how they
+	// are coded, so surface them immediately instead of retrying.
+	if quotaError(err) != nil {
+		return false
+	}
+	switch apiErr.Code {
+	case 500, 502, 503, 429:
+		return true
+	}
+	for _, e := range apiErr.Errors {
+		if e.Reason == "backendError" || e.Reason == "rateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// withAPIRetries calls fn, retrying transient compute API errors with
+// exponential backoff up to --api-retries attempts. Non-retryable errors are
+// returned immediately.
+func withAPIRetries(fn func() error) error {
+	backoff := wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Steps:    *apiRetries,
+	}
+	var lastErr error
+	if waitErr := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		lastErr = fn()
+		if lastErr == nil {
+			return true, nil
+		}
+		if !isRetryableAPIError(lastErr) {
+			return false, lastErr
+		}
+		gceMetrics.apiRetryCount.Inc()
+		klog.Warningf("Retrying transient compute API error: %v", lastErr)
+		return false, nil
+	}); waitErr != nil {
+		if lastErr != nil {
+			return lastErr
+		}
+		return waitErr
+	}
+	return nil
+}
+
+// regionFromZone returns the region of a zone, i.e. the zone minus its
+// trailing letter suffix, e.g. europe-west1 for europe-west1-b. It is the
+// single place regions are derived, so every feature needing one (regional
+// disks, subnetworks) parses zones consistently.
+func regionFromZone(zone string) (string, error) {
+	idx := strings.LastIndex(zone, "-")
+	if idx <= 0 || idx == len(zone)-1 {
+		return "", fmt.Errorf("cannot derive a region from zone %q", zone)
+	}
+	// A zone is <region>-<single letter>; anything else (a bare region, an
+	// URL) must be rejected rather than silently mis-split.
+	suffix := zone[idx+1:]
+	if len(suffix) != 1 || suffix[0] < 'a' || suffix[0] > 'z' {
+		return "", fmt.Errorf("cannot derive a region from zone %q", zone)
+	}
+	return zone[:idx], nil
+}
+
+// replicaZonesForZone returns the two zones a regional boot disk for an
+// instance in the given zone is replicated across: the zone itself and a
+// sibling zone in the same region.
+func replicaZonesForZone(zone string) ([]string, error) {
+	region, err := regionFromZone(zone)
+	if err != nil {
+		return nil, err
+	}
+	sibling := region + "-a"
+	if sibling == zone {
+		sibling = region + "-b"
+	}
+	return []string{zone, sibling}, nil
+}
+
+// createRegionalBootDisk creates a regional PD from the configured image,
+// replicated across two zones of the instance's region, waits for it to
+// become READY and returns its URL. The boot-disk labels are applied here, as
+// the instance insert cannot label a disk attached by source.
+func (g *GCERunner) createRegionalBootDisk(name string, imageConfig *internalGCEImage) (string, error) {
+	replicaZones, err := replicaZonesForZone(imageConfig.zone)
+	if err != nil {
+		return "", err
+	}
+	region, err := regionFromZone(imageConfig.zone)
+	if err != nil {
+		return "", err
+	}
+	launchProject := g.launchProject(imageConfig)
+	zoneURLs := make([]string, 0, len(replicaZones))
+	for _, z := range replicaZones {
+		zoneURLs = append(zoneURLs, fmt.Sprintf("projects/%s/zones/%s", launchProject, z))
+	}
+	diskName := name + "-boot"
+	// A source-attached disk has no InitializeParams to inherit labels
+	// through, so they go on the disk itself. The instance-label fallback
+	// mirrors applyBuildID, the only source of instance labels.
+	var instanceLabels map[string]string
+	if id := resolveBuildID(); id != "" {
+		instanceLabels = map[string]string{buildIDKey: id}
+	}
+	labels, err := bootDiskLabels(instanceLabels)
+	if err != nil {
+		return "", err
+	}
+	disk := &compute.Disk{
+		Name:         diskName,
+		SizeGb:       20,
+		SourceImage:  g.sourceImage(imageConfig.image, imageConfig.project),
+		ReplicaZones: zoneURLs,
+		Labels:       labels,
+	}
+	if _, err := g.gceComputeService.RegionDisks.Insert(launchProject, region, disk).Do(); err != nil {
+		return "", fmt.Errorf("could not create regional boot disk %s: %w", diskName, err)
+	}
+	var lastErr error
+	if waitErr := wait.PollUntilContextTimeout(g.pollContext(), provisionPollInterval, *instanceUpTimeout, true,
+		func(ctx context.Context) (bool, error) {
+			d, err := g.gceComputeService.RegionDisks.Get(launchProject, region, diskName).Do()
+			if err != nil {
+				lastErr = err
+				return false, nil
+			}
+			if strings.ToUpper(d.Status) != "READY" {
+				lastErr = fmt.Errorf("regional disk %s not in state READY, was %s", diskName, d.Status)
+				return false, nil
+			}
+			return true, nil
+		}); waitErr != nil {
+		if lastErr != nil {
+			return "", lastErr
+		}
+		return "", waitErr
+	}
+	return fmt.Sprintf("projects/%s/regions/%s/disks/%s", launchProject, region, diskName), nil
+}
+
+// applyNodeAffinities adds the configured sole-tenant node affinities to the
+// instance scheduling. It only appends, so settings from other paths, e.g.
+// on-host-maintenance TERMINATE for accelerators, are preserved.
+func applyNodeAffinities(scheduling *compute.Scheduling) {
+	if len(nodeAffinities) == 0 {
+		return
+	}
+	scheduling.NodeAffinities = append(scheduling.NodeAffinities, nodeAffinities...)
+}
+
+// parseReservationAffinity converts the --reservation-affinity value into the
+// instance's ReservationAffinity, or an error for malformed values. An empty
+// value keeps the project default.
+func parseReservationAffinity(value string) (*compute.ReservationAffinity, error) {
+	switch {
+	case value == "":
+		return nil, nil
+	case value == "any":
+		return &compute.ReservationAffinity{ConsumeReservationType: "ANY_RESERVATION"}, nil
+	case value == "none":
+		return &compute.ReservationAffinity{ConsumeReservationType: "NO_RESERVATION"}, nil
+	case strings.HasPrefix(value, "specific:"):
+		name := strings.TrimPrefix(value, "specific:")
+		if name == "" {
+			return nil, fmt.Errorf("invalid --reservation-affinity %q, specific requires a reservation name", value)
+		}
+		return &compute.ReservationAffinity{
+			ConsumeReservationType: "SPECIFIC_RESERVATION",
+			Key:                    "compute.googleapis.com/reservation-name",
+			Values:                 []string{name},
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid --reservation-affinity %q, must be 'any', 'none' or 'specific:<name>'", value)
+}
+
+// sharedCoreMachinePrefixes are machine types that cannot honor SMT settings
+// such as threads-per-core or a visible core count.
+var sharedCoreMachinePrefixes = []string{"e2-micro", "e2-small", "e2-medium", "f1-", "g1-"}
+
+// applyAdvancedMachineFeatures populates AdvancedMachineFeatures on the
+// instance from the corresponding flags.
+func applyAdvancedMachineFeatures(i *compute.Instance) {
+	if !*enableNestedVirtualization && *threadsPerCore == 0 && *visibleCoreCount == 0 {
+		return
+	}
+	features := &compute.AdvancedMachineFeatures{}
+	if *enableNestedVirtualization {
+		features.EnableNestedVirtualization = true
+		// Nested virtualization only works on Haswell or newer Intel
+		// platforms; without a minimum CPU platform the instance may land on
+		// older hardware.
+		if *minCPUPlatform == "" {
+			klog.Warning("Nested virtualization requires a Haswell or newer Intel CPU platform, consider setting --min-cpu-platform")
+		}
+	}
+	if *threadsPerCore > 0 {
+		features.ThreadsPerCore = int64(*threadsPerCore)
+	}
+	if *visibleCoreCount > 0 {
+		features.VisibleCoreCount = int64(*visibleCoreCount)
+	}
+	if *threadsPerCore > 0 || *visibleCoreCount > 0 {
+		// The machine type is a machine-type path or URL; only the final
+		// component carries the family.
+		machine := i.MachineType
+		if idx := strings.LastIndex(machine, "/"); idx >= 0 {
+			machine = machine[idx+1:]
+		}
+		for _, prefix := range sharedCoreMachinePrefixes {
+			if strings.HasPrefix(machine, prefix) {
+				klog.Warningf("Shared-core machine type %q may not honor --threads-per-core/--visible-core-count", machine)
+				break
+			}
+		}
+	}
+	i.AdvancedMachineFeatures = features
+}
+
+// instanceNetworkInterface builds the instance network interface for the
+// configured --stack-type, requesting an external IPv6 address in addition to
+// the IPv4 NAT address when dual-stack is selected.
+func instanceNetworkInterface() *compute.NetworkInterface {
+	ni := &compute.NetworkInterface{
+		AccessConfigs: []*compute.AccessConfig{
+			{
+				Type: "ONE_TO_ONE_NAT",
+				Name: "External NAT",
+			},
+		},
+	}
+	if *stackType == stackTypeDualStack {
+		ni.StackType = stackTypeDualStack
+		ni.Ipv6AccessConfigs = []*compute.AccessConfig{
+			{
+				Type: "DIRECT_IPV6",
+				Name: "External IPv6",
+			},
+		}
 	}
-	// If instance didn't reach running state in time, return with error now.
+	return ni
+}
+
+// imageSupportsGVNIC reports whether the image advertises the GVNIC
+// guest-os-feature, which GVNIC networking requires.
+func (g *GCERunner) imageSupportsGVNIC(imageConfig *internalGCEImage) bool {
+	img, err := g.gceComputeService.Images.Get(imageConfig.project, imageConfig.image).Do()
 	if err != nil {
-		return name, err
+		klog.Warningf("Failed to fetch image %q to check GVNIC support: %v", imageConfig.image, err)
+		return false
 	}
-	// Instance reached running state in time, make sure that cloud-init is complete
-	if g.isCloudInitUsed(imageConfig.metadata) {
-		cloudInitFinished := false
-		for i := 0; i < 60 && !cloudInitFinished; i++ {
-			if i > 0 {
-				time.Sleep(time.Second * 20)
-			}
-			var finished string
-			finished, err = remote.SSH(name, "ls", "/var/lib/cloud/instance/boot-finished")
-			if err != nil {
-				err = fmt.Errorf("instance %s has not finished cloud-init script: %s", name, finished)
-				continue
-			}
-			cloudInitFinished = true
+	for _, feature := range img.GuestOsFeatures {
+		if feature.Type == "GVNIC" {
+			return true
 		}
 	}
+	return false
+}
 
-	// apply additional kernel arguments to the instance
-	if len(imageConfig.kernelArguments) > 0 {
-		klog.Info("Update kernel arguments")
-		if err := g.updateKernelArguments(instance, imageConfig.image, imageConfig.kernelArguments); err != nil {
-			return name, err
+// tier1MachineFamilies are the machine families supporting TIER_1 total
+// egress bandwidth.
+var tier1MachineFamilies = []string{"n2-", "n2d-", "c2-", "c2d-", "c3-", "c3d-", "m3-", "z3-"}
+
+// networkPerformanceConfig returns the network performance config for an
+// instance with the given machine type, or an error when --network-tier1 is
+// set on a machine family that does not support TIER_1 bandwidth.
+func networkPerformanceConfig(machine string) (*compute.NetworkPerformanceConfig, error) {
+	if !*networkTier1 {
+		return nil, nil
+	}
+	// The machine may be a machine-type path or URL; only the final component
+	// carries the family.
+	if i := strings.LastIndex(machine, "/"); i >= 0 {
+		machine = machine[i+1:]
+	}
+	for _, family := range tier1MachineFamilies {
+		if strings.HasPrefix(machine, family) {
+			return &compute.NetworkPerformanceConfig{TotalEgressBandwidthTier: "TIER_1"}, nil
 		}
 	}
+	return nil, fmt.Errorf("machine type %q does not support TIER_1 egress bandwidth", machine)
+}
 
-	return name, err
+// defaultInstanceScopes returns the OAuth scopes granted to instances when no
+// explicit scope list is configured: a minimal least-privilege set by
+// default, or the broad cloud-platform scope under --broad-scopes.
+func defaultInstanceScopes() []string {
+	if *broadScopes {
+		return []string{"https://www.googleapis.com/auth/cloud-platform"}
+	}
+	return []string{
+		"https://www.googleapis.com/auth/logging.write",
+		"https://www.googleapis.com/auth/monitoring.write",
+		"https://www.googleapis.com/auth/devstorage.read_only",
+	}
+}
+
+// instanceServiceAccounts returns the service accounts block for an instance.
+// A per-image service_account takes precedence over the --service-account
+// flag; when neither is set, the project default service account with the
+// default scope set is used.
+func (g *GCERunner) instanceServiceAccounts(imageConfig *internalGCEImage, defaultServiceAccount string) []*compute.ServiceAccount {
+	email := defaultServiceAccount
+	scopes := defaultInstanceScopes()
+	if *serviceAccount != "" {
+		email = *serviceAccount
+		scopes = strings.Split(*serviceAccountScopes, ",")
+	}
+	if imageConfig.serviceAccount != "" {
+		email = imageConfig.serviceAccount
+		scopes = imageConfig.serviceAccountScopes
+	}
+	return []*compute.ServiceAccount{
+		{
+			Email:  email,
+			Scopes: scopes,
+		},
+	}
+}
+
+// bootDiskLabels returns the labels to apply to the boot disk: the parsed
+// --disk-labels when set, otherwise the instance labels.
+func bootDiskLabels(instanceLabels map[string]string) (map[string]string, error) {
+	if *diskLabels == "" {
+		return instanceLabels, nil
+	}
+	labels, err := parseLabelSelector(*diskLabels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --disk-labels: %w", err)
+	}
+	return labels, nil
+}
+
+// instanceDisks returns the disks to attach to an instance for the given
+// image: the boot disk, followed by the requested number of local SSDs. The
+// local SSDs are SCRATCH disks with NVMe interface and do not affect the
+// boot-disk size.
+func (g *GCERunner) instanceDisks(imageConfig *internalGCEImage) []*compute.AttachedDisk {
+	disks := []*compute.AttachedDisk{
+		{
+			AutoDelete: true,
+			Boot:       true,
+			Type:       "PERSISTENT",
+			// If empty, GCE generates the device name.
+			DeviceName: *bootDiskDeviceName,
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				SourceImage: g.sourceImage(imageConfig.image, imageConfig.project),
+				DiskSizeGb:  20,
+			},
+		},
+	}
+	for _, feature := range imageConfig.guestOsFeatures {
+		disks[0].GuestOsFeatures = append(disks[0].GuestOsFeatures,
+			&compute.GuestOsFeature{Type: strings.ToUpper(feature)})
+	}
+	for i := int64(0); i < imageConfig.localSSDCount; i++ {
+		disks = append(disks, &compute.AttachedDisk{
+			AutoDelete: true,
+			Type:       "SCRATCH",
+			Interface:  "NVME",
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				DiskType:   fmt.Sprintf("zones/%s/diskTypes/local-ssd", imageConfig.zone),
+				DiskSizeGb: localSSDSizeGb,
+			},
+		})
+	}
+	return disks
 }
 
 func (g *GCERunner) isCloudInitUsed(metadata *compute.Metadata) bool {
@@ -687,20 +3278,48 @@ func (g *GCERunner) isCloudInitUsed(metadata *compute.Metadata) bool {
 }
 
 func (g *GCERunner) sourceImage(image, imageProject string) string {
+	// Images pinned by full resource URL (e.g. from a build pipeline) are used
+	// verbatim instead of being wrapped in a projects/.../images/ path again.
+	if strings.HasPrefix(image, "projects/") || strings.HasPrefix(image, "https://") {
+		return image
+	}
 	return fmt.Sprintf("projects/%s/global/images/%s", imageProject, image)
 }
 
+// maxInstanceNameLength is GCE's limit on instance name length.
+const maxInstanceNameLength = 63
+
+// safeInstanceName makes name a valid GCE instance name: lowercase and
+// within the 63-character limit. Overly long names are truncated and the
+// overflow replaced with a short hash of the full name, so distinct long
+// names never collapse into the same instance.
+func safeInstanceName(name string) string {
+	name = strings.ToLower(name)
+	if len(name) <= maxInstanceNameLength {
+		return name
+	}
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:8]
+	name = strings.TrimRight(name[:maxInstanceNameLength-len(digest)-1], "-")
+	return name + "-" + digest
+}
+
 func (g *GCERunner) imageToInstanceName(imageConfig *internalGCEImage) string {
+	var name string
 	if imageConfig.machine == "" {
-		return g.cfg.InstanceNamePrefix + "-" + imageConfig.image
+		name = g.cfg.InstanceNamePrefix + "-" + imageConfig.image
+	} else {
+		// For benchmark test, node name has the format 'machine-image-uuid' to run
+		// different machine types with the same image in parallel
+		name = imageConfig.machine + "-" + imageConfig.image + "-" + uuid.New().String()[:8]
+	}
+	if *instanceNameSuffix != "" {
+		name += "-" + *instanceNameSuffix
 	}
-	// For benchmark test, node name has the format 'machine-image-uuid' to run
-	// different machine types with the same image in parallel
-	return imageConfig.machine + "-" + imageConfig.image + "-" + uuid.New().String()[:8]
+	return safeInstanceName(name)
 }
 
 func (g *GCERunner) registerGceHostIP(host string) error {
-	instance, err := g.gceComputeService.Instances.Get(*project, *zone, host).Do()
+	instance, err := g.gceComputeService.Instances.Get(g.hostProject(host), g.hostZone(host), host).Do()
 	if err != nil {
 		return err
 	}
@@ -723,6 +3342,17 @@ func (g *GCERunner) getExternalIP(instance *compute.Instance) string {
 			}
 		}
 	}
+	// Fall back to the external IPv6 address, e.g. on a dual-stack interface
+	// without an IPv4 NAT address.
+	for i := range instance.NetworkInterfaces {
+		ni := instance.NetworkInterfaces[i]
+		for j := range ni.Ipv6AccessConfigs {
+			ac := ni.Ipv6AccessConfigs[j]
+			if len(ac.ExternalIpv6) > 0 {
+				return ac.ExternalIpv6
+			}
+		}
+	}
 	return ""
 }
 func (g *GCERunner) updateKernelArguments(instance *compute.Instance, image string, kernelArgs []string) error {
@@ -730,13 +3360,7 @@ func (g *GCERunner) updateKernelArguments(instance *compute.Instance, image stri
 
 	var cmd []string
 	if strings.Contains(image, "cos") {
-		cmd = []string{
-			"dir=$(mktemp -d)",
-			"mount /dev/sda12 ${dir}",
-			fmt.Sprintf("sed -i -e \"s|cros_efi|cros_efi %s|g\" ${dir}/efi/boot/grub.cfg", kernelArgsString),
-			"umount ${dir}",
-			"rmdir ${dir}",
-		}
+		cmd = cosKernelArgumentsCommands(image, kernelArgsString)
 	}
 
 	if strings.Contains(image, "ubuntu") {
@@ -746,9 +3370,15 @@ func (g *GCERunner) updateKernelArguments(instance *compute.Instance, image stri
 		}
 	}
 
+	if strings.Contains(image, "flatcar") {
+		cmd = flatcarKernelArgumentsCommands(kernelArgsString)
+	}
+
+	// Kernel arguments are only set when the image config explicitly requests
+	// them, so silently dropping them would run the suite with the wrong
+	// kernel config.
 	if len(cmd) == 0 {
-		klog.Warningf("The image %s does not support adding an additional kernel arguments", image)
-		return nil
+		return fmt.Errorf("cannot apply kernel arguments %q: image %s is not supported (cos, ubuntu and flatcar are)", kernelArgsString, image)
 	}
 
 	out, err := remote.SSH(instance.Name, "sh", "-c", fmt.Sprintf("'%s'", strings.Join(cmd, "&&")))
@@ -761,40 +3391,646 @@ func (g *GCERunner) updateKernelArguments(instance *compute.Instance, image stri
 		return err
 	}
 
+	// The sed substitution can fail silently, e.g. when the grub.cfg path
+	// changed across COS milestones, so confirm the arguments actually took
+	// effect instead of running the suite with the wrong kernel config.
+	return verifyKernelArguments(instance.Name, kernelArgs)
+}
+
+// kernelArgsSSH is the SSH function used for the kernel-argument
+// verification, replaceable in tests.
+var kernelArgsSSH = remote.SSH
+
+// verifyKernelArguments checks that every requested kernel argument is
+// present in /proc/cmdline, returning an error listing the missing ones.
+func verifyKernelArguments(host string, kernelArgs []string) error {
+	out, err := kernelArgsSSH(host, "cat", "/proc/cmdline")
+	if err != nil {
+		return fmt.Errorf("could not read /proc/cmdline on %s: %w", host, err)
+	}
+	var missing []string
+	for _, arg := range kernelArgs {
+		if !strings.Contains(out, arg) {
+			missing = append(missing, arg)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("kernel arguments %v did not take effect on %s, /proc/cmdline is: %s", missing, host, strings.TrimSpace(out))
+	}
 	return nil
 }
 
-func (g *GCERunner) machineType(machine string) string {
-	if machine == "" && *instanceType != "" {
-		machine = *instanceType
-	} else {
-		machine = defaultGCEMachine
+// fileInjection is one entry of the --file-inject manifest.
+type fileInjection struct {
+	// Local is the path of the file on the runner.
+	Local string `json:"local"`
+	// Remote is the destination path on the node.
+	Remote string `json:"remote"`
+}
+
+// parseFileInjectManifest parses the --file-inject manifest.
+func parseFileInjectManifest(path string) ([]fileInjection, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file-inject manifest: %w", err)
+	}
+	var injections []fileInjection
+	if err := yaml.Unmarshal(data, &injections); err != nil {
+		return nil, fmt.Errorf("could not parse file-inject manifest %q: %w", path, err)
+	}
+	for _, fi := range injections {
+		if fi.Local == "" || fi.Remote == "" {
+			return nil, fmt.Errorf("invalid file-inject entry %+v in %q; local and remote must both be set", fi, path)
+		}
 	}
-	return fmt.Sprintf("zones/%s/machineTypes/%s", *zone, machine)
+	return injections, nil
 }
-func (g *GCERunner) rebootInstance(instance *compute.Instance) error {
-	// wait until the instance will not response to SSH
-	klog.Info("Reboot the node and wait for instance not to be available via SSH")
-	if waitErr := wait.PollImmediate(5*time.Second, 5*time.Minute, func() (bool, error) {
-		if _, err := remote.SSH(instance.Name, "reboot"); err != nil {
-			return true, nil
+
+// copyFileToHost is the scp function used for file injection, replaceable in
+// tests.
+var copyFileToHost = remote.CopyFileToHost
+
+// instanceUpSSH is the SSH function used for the readiness check, and
+// readinessSleep the sleep applied before the first attempt; both are
+// replaceable in tests.
+var instanceUpSSH = remote.SSH
+var readinessSleep = time.Sleep
+
+// injectFiles copies the files listed in the --file-inject manifest onto the
+// node.
+func (g *GCERunner) injectFiles(host string) error {
+	if *fileInjectManifest == "" {
+		return nil
+	}
+	injections, err := parseFileInjectManifest(*fileInjectManifest)
+	if err != nil {
+		return err
+	}
+	for _, fi := range injections {
+		klog.V(2).Infof("Copying %q to %s:%s", fi.Local, host, fi.Remote)
+		if out, err := copyFileToHost(host, fi.Local, fi.Remote); err != nil {
+			return fmt.Errorf("failed to copy %q to %s:%s: %v, output: %q", fi.Local, host, fi.Remote, err, out)
 		}
+	}
+	return nil
+}
 
-		return false, nil
-	}); waitErr != nil {
-		return fmt.Errorf("the instance %s still response to SSH: %v", instance.Name, waitErr)
+// journalSSH and copyFileFromHost are the SSH/scp functions used for journal
+// collection, replaceable in tests.
+var journalSSH = remote.SSH
+var copyFileFromHost = remote.CopyFileFromHost
+
+// collectJournalLog fetches the node's journald log and stores it as
+// journal.log in the artifacts for the host. The serial console is truncated
+// and lossy, so the journal is where the real diagnostics live.
+func (g *GCERunner) collectJournalLog(host string) error {
+	const remotePath = "/tmp/journal.log"
+	if out, err := journalSSH(host, "sh", "-c", fmt.Sprintf("'journalctl --no-pager -o short-precise > %s'", remotePath)); err != nil {
+		return fmt.Errorf("failed to dump journal on %q: %v, output: %q", host, err, out)
+	}
+	localPath := filepath.Join(os.TempDir(), fmt.Sprintf("%s-journal.log", host))
+	defer os.Remove(localPath)
+	if out, err := copyFileFromHost(host, remotePath, localPath); err != nil {
+		return fmt.Errorf("failed to fetch journal from %q: %v, output: %q", host, err, out)
+	}
+	content, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	return remote.WriteLog(host, "journal.log", string(content))
+}
+
+// runnerMetrics holds the Prometheus series published via
+// --metrics-listen-addr.
+type runnerMetrics struct {
+	registry            *prometheus.Registry
+	instancesCreated    prometheus.Counter
+	creationFailures    prometheus.Counter
+	instancesDeleted    prometheus.Counter
+	apiRetryCount       prometheus.Counter
+	provisioningSeconds prometheus.Histogram
+	testSeconds         prometheus.Histogram
+}
+
+func newRunnerMetrics() *runnerMetrics {
+	m := &runnerMetrics{
+		registry: prometheus.NewRegistry(),
+		instancesCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "node_e2e_instances_created_total",
+			Help: "Number of GCE instances created.",
+		}),
+		creationFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "node_e2e_instance_creation_failures_total",
+			Help: "Number of GCE instance creations that failed.",
+		}),
+		instancesDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "node_e2e_instances_deleted_total",
+			Help: "Number of GCE instances deleted.",
+		}),
+		apiRetryCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "node_e2e_api_retries_total",
+			Help: "Number of retried transient compute API errors.",
+		}),
+		provisioningSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "node_e2e_provisioning_duration_seconds",
+			Help:    "Time from instance creation start to SSH readiness.",
+			Buckets: prometheus.ExponentialBuckets(15, 2, 8),
+		}),
+		testSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "node_e2e_test_duration_seconds",
+			Help:    "Test suite duration per image, including provisioning.",
+			Buckets: prometheus.ExponentialBuckets(60, 2, 8),
+		}),
+	}
+	m.registry.MustRegister(m.instancesCreated, m.creationFailures, m.instancesDeleted,
+		m.apiRetryCount, m.provisioningSeconds, m.testSeconds)
+	return m
+}
+
+// gceMetrics is updated unconditionally; the HTTP server exposing it only
+// starts when --metrics-listen-addr is set.
+var gceMetrics = newRunnerMetrics()
+
+// startMetricsServer serves gceMetrics on /metrics at addr until the runner
+// shuts down.
+func (g *GCERunner) startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gceMetrics.registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			klog.Warningf("Metrics server failed: %v", err)
+		}
+	}()
+	go func() {
+		<-g.pollContext().Done()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			klog.Warningf("Failed to shut down metrics server: %v", err)
+		}
+	}()
+}
+
+// metadataServerURL is the GCE metadata server endpoint, overridable in
+// tests.
+var metadataServerURL = "http://metadata.google.internal/computeMetadata/v1"
+
+// metadataServerValue queries the metadata server for the value at path.
+func metadataServerValue(valuePath string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, metadataServerURL+"/"+valuePath, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s for %q", resp.Status, valuePath)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// defaultProjectAndZoneFromMetadata fills empty --project/--zone flags from
+// the GCE metadata server, for runners that themselves run on a GCE VM.
+// Failures leave the flags empty, so the usual hard errors still apply.
+func defaultProjectAndZoneFromMetadata() {
+	if *project == "" {
+		if id, err := metadataServerValue("project/project-id"); err != nil {
+			klog.V(2).Infof("Could not auto-detect project from the metadata server: %v", err)
+		} else {
+			*project = id
+			klog.Infof("Auto-detected --project=%s from the metadata server", id)
+		}
+	}
+	if *zone == "" {
+		if z, err := metadataServerValue("instance/zone"); err != nil {
+			klog.V(2).Infof("Could not auto-detect zone from the metadata server: %v", err)
+		} else {
+			// The metadata server returns projects/<number>/zones/<zone>.
+			*zone = path.Base(z)
+			klog.Infof("Auto-detected --zone=%s from the metadata server", *zone)
+		}
+	}
+}
+
+// buildIDKey is the stable label and metadata key carrying the CI build
+// identifier on created instances.
+const buildIDKey = "node-e2e-build-id"
+
+// resolveBuildID returns the --build-id flag, falling back to the PROW_JOB_ID
+// and BUILD_ID environment variables.
+func resolveBuildID() string {
+	if *buildID != "" {
+		return *buildID
+	}
+	if id := os.Getenv("PROW_JOB_ID"); id != "" {
+		return id
+	}
+	return os.Getenv("BUILD_ID")
+}
+
+// applyBuildID tags the instance with the CI build identifier as both a label
+// and a metadata item, so leaked instances and uploaded artifacts can be
+// correlated back to the job that created them.
+func applyBuildID(i *compute.Instance) {
+	id := resolveBuildID()
+	if id == "" {
+		return
+	}
+	if i.Labels == nil {
+		i.Labels = make(map[string]string)
+	}
+	i.Labels[buildIDKey] = id
+	if i.Metadata == nil {
+		i.Metadata = &compute.Metadata{}
+	}
+	value := id
+	i.Metadata.Items = append(i.Metadata.Items, &compute.MetadataItems{
+		Key:   buildIDKey,
+		Value: &value,
+	})
+}
+
+// keepForDebugging reports whether a finished run should keep its instance
+// for debugging instead of deleting it.
+func keepForDebugging(exitOK bool) bool {
+	return *keepOnFailure && !exitOK
+}
+
+// serialStreamInterval is how often the serial console is polled in
+// --stream-serial mode.
+const serialStreamInterval = 5 * time.Second
+
+// streamSerialOutput polls the serial console of the instance and prints
+// newly appeared output to stderr prefixed with the host name, until ctx is
+// cancelled. Poll errors are ignored; the instance may not exist yet.
+func (g *GCERunner) streamSerialOutput(ctx context.Context, host, zone string) {
+	var cursor int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(serialStreamInterval):
+		}
+		out, err := g.gceComputeService.Instances.GetSerialPortOutput(g.hostProject(host), zone, host).Port(1).Start(cursor).Do()
+		if err != nil {
+			continue
+		}
+		var chunk string
+		chunk, cursor = serialChunk(cursor, out)
+		for _, line := range strings.Split(strings.TrimRight(chunk, "\n"), "\n") {
+			if line == "" {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%s: %s\n", host, line)
+		}
+	}
+}
+
+// serialChunk returns the part of the serial output past cursor and the
+// cursor for the next poll. The API may return bytes from before the
+// requested start when the buffer rotated, so any overlap is trimmed.
+func serialChunk(cursor int64, out *compute.SerialPortOutput) (string, int64) {
+	contents := out.Contents
+	if out.Start < cursor {
+		skip := cursor - out.Start
+		if skip >= int64(len(contents)) {
+			contents = ""
+		} else {
+			contents = contents[skip:]
+		}
+	}
+	next := out.Next
+	if next == 0 {
+		next = out.Start + int64(len(out.Contents))
+	}
+	return contents, next
+}
+
+// preflightSSH is the SSH function used for the preflight script, replaceable
+// in tests.
+var preflightSSH = remote.SSH
+
+// runPreflightScript copies the --preflight-script onto the host and runs it.
+// A non-zero exit fails the image before the suite starts, separating
+// node-environment problems (swap still on, a missing sysctl) from test
+// failures.
+func (g *GCERunner) runPreflightScript(host string) error {
+	if *preflightScript == "" {
+		return nil
+	}
+	const remotePath = "/tmp/preflight.sh"
+	if out, err := copyFileToHost(host, *preflightScript, remotePath); err != nil {
+		return fmt.Errorf("failed to copy preflight script to %s: %v, output: %q", host, err, out)
+	}
+	out, err := preflightSSH(host, "sh", remotePath)
+	if err != nil {
+		return fmt.Errorf("preflight script failed on %q: %v, output: %q", host, err, out)
+	}
+	klog.V(2).Infof("Preflight script passed on %q: %s", host, out)
+	return nil
+}
+
+// sampleSSH is the SSH function used for resource sampling, replaceable in
+// tests.
+var sampleSSH = remote.SSH
+
+// sampleHostResources takes a brief node-level CPU and memory sample on the
+// host and condenses it into a one-line summary.
+func (g *GCERunner) sampleHostResources(host string) (string, error) {
+	loadavg, err := sampleSSH(host, "cat", "/proc/loadavg")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /proc/loadavg on %q: %v, output: %q", host, err, loadavg)
+	}
+	meminfo, err := sampleSSH(host, "sh", "-c", "'grep -e MemTotal -e MemAvailable /proc/meminfo'")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /proc/meminfo on %q: %v, output: %q", host, err, meminfo)
+	}
+	return parseResourceSample(loadavg, meminfo)
+}
+
+// parseResourceSample condenses /proc/loadavg and /proc/meminfo output into a
+// one-line summary.
+func parseResourceSample(loadavg, meminfo string) (string, error) {
+	fields := strings.Fields(loadavg)
+	if len(fields) < 3 {
+		return "", fmt.Errorf("unexpected /proc/loadavg output %q", loadavg)
+	}
+	summary := fmt.Sprintf("load1=%s load5=%s load15=%s", fields[0], fields[1], fields[2])
+	for _, line := range strings.Split(meminfo, "\n") {
+		kv := strings.Fields(line)
+		if len(kv) < 2 {
+			continue
+		}
+		switch strings.TrimSuffix(kv[0], ":") {
+		case "MemTotal":
+			summary += " mem_total_kb=" + kv[1]
+		case "MemAvailable":
+			summary += " mem_available_kb=" + kv[1]
+		}
+	}
+	return summary, nil
+}
+
+// gpuDriverInstallCommand returns the command installing the GPU driver
+// version configured for the image, or an empty string for images without a
+// known driver installer.
+func gpuDriverInstallCommand(image, version string) string {
+	if version == "" {
+		version = defaultGPUDriverVersion
+	}
+	if strings.Contains(image, "cos") {
+		if version == defaultGPUDriverVersion {
+			return "cos-extensions install gpu"
+		}
+		return fmt.Sprintf("cos-extensions install gpu -- -version=%s", version)
+	}
+	if strings.Contains(image, "ubuntu") {
+		if version == defaultGPUDriverVersion {
+			return "ubuntu-drivers install --gpgpu"
+		}
+		return fmt.Sprintf("ubuntu-drivers install --gpgpu nvidia:%s", version)
+	}
+	return ""
+}
+
+// installGPUDrivers installs GPU drivers on the instance, pinned to the
+// per-image gpu_driver_version, and verifies the driver works before handing
+// the instance off to the suite. Images without accelerators are skipped.
+func (g *GCERunner) installGPUDrivers(host string, imageConfig *internalGCEImage) error {
+	if len(imageConfig.resources.Accelerators) == 0 {
+		klog.V(2).Infof("Image %s has no accelerators attached, skipping GPU driver install", imageConfig.image)
+		return nil
+	}
+	cmd := gpuDriverInstallCommand(imageConfig.image, imageConfig.gpuDriverVersion)
+	if cmd == "" {
+		klog.Warningf("The image %s does not support installing GPU drivers", imageConfig.image)
+		return nil
+	}
+	klog.Infof("Installing GPU driver version %q on %q", imageConfig.gpuDriverVersion, host)
+	if out, err := remote.SSH(host, "sh", "-c", fmt.Sprintf("'%s'", cmd)); err != nil {
+		return fmt.Errorf("failed to install GPU drivers on %q: %v, output: %s", host, err, out)
+	}
+	if out, err := remote.SSH(host, "nvidia-smi"); err != nil {
+		return fmt.Errorf("GPU driver verification failed on %q: %v, output: %s", host, err, out)
+	}
+	return nil
+}
+
+// validateAccelerators checks before the insert that every requested
+// accelerator type is offered in the target zone and the requested count does
+// not exceed its per-instance maximum, so misconfigurations fail with a clear
+// error instead of a confusing insert failure.
+func (g *GCERunner) validateAccelerators(imageConfig *internalGCEImage) error {
+	if len(imageConfig.resources.Accelerators) == 0 {
+		return nil
+	}
+	available := make(map[string]int64)
+	if err := g.gceComputeService.AcceleratorTypes.List(g.launchProject(imageConfig), imageConfig.zone).Pages(context.Background(),
+		func(atl *compute.AcceleratorTypeList) error {
+			for _, at := range atl.Items {
+				available[at.Name] = at.MaximumCardsPerInstance
+			}
+			return nil
+		},
+	); err != nil {
+		return fmt.Errorf("failed to list accelerator types in zone %q: %w", imageConfig.zone, err)
+	}
+	for _, accelerator := range imageConfig.resources.Accelerators {
+		// The configured type may be a full URL or path; only the final
+		// component carries the type name.
+		name := accelerator.Type
+		if idx := strings.LastIndex(name, "/"); idx >= 0 {
+			name = name[idx+1:]
+		}
+		maxCards, ok := available[name]
+		if !ok {
+			return fmt.Errorf("accelerator type %q is not available in zone %q", name, imageConfig.zone)
+		}
+		if accelerator.Count > maxCards {
+			return fmt.Errorf("accelerator type %q supports at most %d cards per instance in zone %q, %d requested",
+				name, maxCards, imageConfig.zone, accelerator.Count)
+		}
+	}
+	return nil
+}
+
+// acceleratorType returns the accelerator-type resource for the image's zone
+// and launch project. The configured type may already be an accelerator-type
+// path or full URL; use it verbatim instead of wrapping it into an invalid
+// double-URL.
+func (g *GCERunner) acceleratorType(imageConfig *internalGCEImage, acceleratorType string) string {
+	if strings.Contains(acceleratorType, "/acceleratorTypes/") {
+		return acceleratorType
+	}
+	return fmt.Sprintf(acceleratorTypeResourceFormat, g.launchProject(imageConfig), imageConfig.zone, acceleratorType)
+}
+
+// cosMilestoneRe extracts the milestone from a COS image name, e.g. 109 from
+// cos-stable-109-17800-0-51 or cos-arm64-109-17800-0-51.
+var cosMilestoneRe = regexp.MustCompile(`cos-(?:[a-z0-9]+-)*?(\d{2,3})-`)
+
+// parseCOSMilestone returns the COS milestone encoded in the image name.
+func parseCOSMilestone(image string) (int, error) {
+	m := cosMilestoneRe.FindStringSubmatch(image)
+	if m == nil {
+		return 0, fmt.Errorf("no COS milestone in image name %q", image)
+	}
+	return strconv.Atoi(m[1])
+}
+
+// cosKernelArgumentsCommands returns the shell commands rewriting the kernel
+// command line on the EFI partition of a COS image. The grub config location
+// moved between COS milestones: milestones before 101 kept it at the root of
+// the partition, newer ones keep it under efi/boot. Unknown milestones fall
+// back to the current layout with a warning.
+func cosKernelArgumentsCommands(image, kernelArgsString string) []string {
+	grubCfg := "${dir}/efi/boot/grub.cfg"
+	if milestone, err := parseCOSMilestone(image); err != nil {
+		klog.Warningf("Could not detect the COS milestone of image %s, assuming the current grub layout: %v", image, err)
+	} else if milestone < 101 {
+		grubCfg = "${dir}/boot/grub.cfg"
+	}
+	return []string{
+		"dir=$(mktemp -d)",
+		"mount /dev/sda12 ${dir}",
+		fmt.Sprintf("sed -i -e \"s|cros_efi|cros_efi %s|g\" %s", kernelArgsString, grubCfg),
+		"umount ${dir}",
+		"rmdir ${dir}",
+	}
+}
+
+// flatcarKernelArgumentsCommands appends the kernel arguments to the grub
+// config on the OEM partition, which Flatcar's bootloader reads on boot.
+func flatcarKernelArgumentsCommands(kernelArgsString string) []string {
+	return []string{
+		"dir=$(mktemp -d)",
+		"mount /dev/disk/by-label/OEM ${dir}",
+		fmt.Sprintf("echo 'set linux_append=\"$linux_append %s\"' >> ${dir}/grub.cfg", kernelArgsString),
+		"umount ${dir}",
+		"rmdir ${dir}",
+	}
+}
+
+// customMachineTypeRe matches custom machine types of the forms
+// custom-<cpu>-<memory-mb> and <family>-custom-<cpu>-<memory-mb>, with an
+// optional -ext suffix for extended memory.
+var customMachineTypeRe = regexp.MustCompile(`^(?:([a-z0-9]+)-)?custom-(\d+)-(\d+)(-ext)?$`)
+
+// customMemoryPerVCPUMB holds the memory-per-vCPU bounds, in MB, enforced per
+// machine family for custom types without extended memory. The empty family
+// is the N1-based bare custom-<cpu>-<mem> form.
+var customMemoryPerVCPUMB = map[string]struct{ min, max int }{
+	"":    {922, 6656},
+	"e2":  {512, 8192},
+	"n2":  {512, 8192},
+	"n2d": {512, 8192},
+	"n4":  {2048, 8192},
+}
+
+// validateCustomMachineType rejects malformed custom machine types, e.g.
+// custom-6-20480 or n2-custom-8-32768 with a typo, before they turn into a
+// confusing insert failure. Predefined machine types pass through untouched
+// and are validated by the API.
+func validateCustomMachineType(machine string) error {
+	// The machine may be a machine-type path or URL; only the final component
+	// carries the type.
+	if idx := strings.LastIndex(machine, "/"); idx >= 0 {
+		machine = machine[idx+1:]
+	}
+	if !strings.Contains(machine, "custom-") {
+		return nil
+	}
+	m := customMachineTypeRe.FindStringSubmatch(machine)
+	if m == nil {
+		return fmt.Errorf("invalid custom machine type %q, expected custom-<cpu>-<memory-mb> or <family>-custom-<cpu>-<memory-mb>", machine)
+	}
+	family, ext := m[1], m[4] != ""
+	cpus, _ := strconv.Atoi(m[2])
+	memoryMB, _ := strconv.Atoi(m[3])
+	limits, known := customMemoryPerVCPUMB[family]
+	if !known {
+		return fmt.Errorf("invalid custom machine type %q: unsupported machine family %q", machine, family)
+	}
+	if cpus != 1 && cpus%2 != 0 {
+		return fmt.Errorf("invalid custom machine type %q: vCPU count must be 1 or even, got %d", machine, cpus)
+	}
+	if memoryMB <= 0 || memoryMB%256 != 0 {
+		return fmt.Errorf("invalid custom machine type %q: memory must be a positive multiple of 256 MB, got %d", machine, memoryMB)
+	}
+	if memoryMB < cpus*limits.min {
+		return fmt.Errorf("invalid custom machine type %q: memory must be at least %d MB per vCPU for this family, got %d MB for %d vCPUs", machine, limits.min, memoryMB, cpus)
+	}
+	// Extended memory lifts the upper bound.
+	if !ext && memoryMB > cpus*limits.max {
+		return fmt.Errorf("invalid custom machine type %q: memory above %d MB per vCPU requires the -ext suffix, got %d MB for %d vCPUs", machine, limits.max, memoryMB, cpus)
+	}
+	return nil
+}
+
+func (g *GCERunner) machineType(zone, machine string) string {
+	if machine == "" {
+		if *instanceType != "" {
+			machine = *instanceType
+		} else {
+			machine = defaultGCEMachine
+		}
+	}
+	// The configured machine may already be a machine-type path or full URL
+	// (e.g. zones/<zone>/machineTypes/<type>); use it verbatim instead of
+	// wrapping it into an invalid URL.
+	if strings.Contains(machine, "/machineTypes/") {
+		return machine
 	}
+	return fmt.Sprintf("zones/%s/machineTypes/%s", zone, machine)
+}
+
+// rebootSSH is the SSH function used by rebootInstance, replaceable in tests.
+var rebootSSH = remote.SSH
 
-	// wait until the instance will response again to SSH
-	klog.Info("Wait for instance to be available via SSH")
-	if waitErr := wait.PollImmediate(30*time.Second, 5*time.Minute, func() (bool, error) {
-		if _, err := remote.SSH(instance.Name, "sh", "-c", "date"); err != nil {
+func (g *GCERunner) rebootInstance(instance *compute.Instance) error {
+	// Capture the boot id before rebooting. It changes on every boot, so the
+	// reboot is detected even on nodes that are back up before an SSH-down
+	// window could be observed.
+	bootID, err := rebootSSH(instance.Name, "cat", "/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return fmt.Errorf("could not read the boot id of instance %s: %w", instance.Name, err)
+	}
+	klog.Info("Reboot the node and wait for the boot id to change")
+	if out, err := rebootSSH(instance.Name, "reboot"); err != nil {
+		// The reboot usually kills the connection before the command returns.
+		klog.V(2).Infof("Reboot command on instance %s returned: out: %s, err: %v", instance.Name, out, err)
+	}
+	if waitErr := wait.PollImmediate(5*time.Second, 5*time.Minute, func() (bool, error) {
+		current, err := rebootSSH(instance.Name, "cat", "/proc/sys/kernel/random/boot_id")
+		if err != nil {
+			// Still rebooting.
 			return false, nil
 		}
-		return true, nil
+		return bootIDChanged(bootID, current), nil
 	}); waitErr != nil {
-		return fmt.Errorf("the instance %s does not response to SSH: %v", instance.Name, waitErr)
+		return fmt.Errorf("the boot id of instance %s did not change: %v", instance.Name, waitErr)
 	}
 
 	return nil
 }
+
+// bootIDChanged reports whether the two boot-id readings differ, ignoring
+// surrounding whitespace. Empty readings are never treated as a change.
+func bootIDChanged(before, after string) bool {
+	before = strings.TrimSpace(before)
+	after = strings.TrimSpace(after)
+	if before == "" || after == "" {
+		return false
+	}
+	return before != after
+}
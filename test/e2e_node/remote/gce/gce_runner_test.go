@@ -0,0 +1,3853 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	"k8s.io/kubernetes/test/e2e_node/remote"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+// fakeComputeService starts a fake GCE API endpoint served by handler and
+// returns a compute service talking to it. The server is cleaned up when the
+// test finishes.
+func fakeComputeService(t *testing.T, handler http.HandlerFunc) *compute.Service {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	cs, err := compute.NewService(context.Background(),
+		option.WithoutAuthentication(), option.WithEndpoint(server.URL))
+	if err != nil {
+		t.Fatalf("failed to create fake compute service: %v", err)
+	}
+	return cs
+}
+
+func TestNetworkPerformanceConfig(t *testing.T) {
+	oldTier1 := *networkTier1
+	defer func() { *networkTier1 = oldTier1 }()
+
+	*networkTier1 = false
+	cfg, err := networkPerformanceConfig("zones/us-west1-b/machineTypes/e2-medium")
+	if err != nil || cfg != nil {
+		t.Errorf("expected no performance config when disabled, got %v, %v", cfg, err)
+	}
+
+	*networkTier1 = true
+	cfg, err = networkPerformanceConfig("zones/us-west1-b/machineTypes/n2-standard-32")
+	if err != nil {
+		t.Fatalf("expected TIER_1 to be supported on n2, got: %v", err)
+	}
+	if cfg == nil || cfg.TotalEgressBandwidthTier != "TIER_1" {
+		t.Errorf("expected TIER_1 performance config, got %+v", cfg)
+	}
+
+	if _, err = networkPerformanceConfig("zones/us-west1-b/machineTypes/e2-medium"); err == nil {
+		t.Error("expected TIER_1 to be rejected on e2 machine types")
+	}
+}
+
+func TestPickZoneRoundRobin(t *testing.T) {
+	oldZones := *zones
+	defer func() { *zones = oldZones }()
+	*zones = "us-west1-a,us-west1-b"
+
+	g := &GCERunner{cfg: remote.Config{}}
+	want := []string{"us-west1-a", "us-west1-b", "us-west1-a"}
+	for i, w := range want {
+		if got := g.pickZone(); got != w {
+			t.Errorf("pickZone() call %d = %q, want %q", i, got, w)
+		}
+	}
+}
+
+func TestDeleteGCEInstanceUsesCreationZone(t *testing.T) {
+	var deletePath string
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deletePath = r.URL.Path
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+	g.recordHostZone("test-instance", "us-west1-b")
+
+	// Deletion must target the zone the instance was created in, not the
+	// global --zone.
+	g.deleteGCEInstance("test-instance")
+	if !strings.Contains(deletePath, "/zones/us-west1-b/instances/test-instance") {
+		t.Errorf("expected deletion in the creation zone, got request path %q", deletePath)
+	}
+}
+
+func TestCreateGCEInstanceZoneFallback(t *testing.T) {
+	oldZones := *zones
+	defer func() { *zones = oldZones }()
+	*zones = "us-west1-a,us-west1-b"
+
+	t.Run("stockout retries the next zone", func(t *testing.T) {
+		var insertZones []string
+		cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/instances"):
+				parts := strings.Split(r.URL.Path, "/")
+				for i, p := range parts {
+					if p == "zones" {
+						insertZones = append(insertZones, parts[i+1])
+					}
+				}
+				fmt.Fprint(w, `{"name": "op", "error": {"errors": [{"code": "ZONE_RESOURCE_POOL_EXHAUSTED", "message": "out of stock"}]}}`)
+			case strings.Contains(r.URL.Path, "/projects/") && !strings.Contains(r.URL.Path, "/zones/"):
+				fmt.Fprint(w, `{"defaultServiceAccount": "default-sa@project.iam.gserviceaccount.com"}`)
+			default:
+				http.NotFound(w, r)
+			}
+		})
+		g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+		_, err := g.createGCEInstance(&internalGCEImage{image: "cos-stable", project: "cos-cloud"})
+		if err == nil {
+			t.Fatal("expected creation to fail when all zones are out of stock")
+		}
+		if len(insertZones) != 2 || insertZones[0] == insertZones[1] {
+			t.Errorf("expected insert attempts in both zones, got %v", insertZones)
+		}
+		if !strings.Contains(err.Error(), "us-west1-a") || !strings.Contains(err.Error(), "us-west1-b") {
+			t.Errorf("expected aggregated errors mentioning both zones, got: %v", err)
+		}
+	})
+
+	t.Run("quota errors are not retried in other zones", func(t *testing.T) {
+		inserts := 0
+		cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/instances"):
+				inserts++
+				fmt.Fprint(w, `{"name": "op", "error": {"errors": [{"code": "QUOTA_EXCEEDED", "message": "quota exceeded"}]}}`)
+			case strings.Contains(r.URL.Path, "/projects/") && !strings.Contains(r.URL.Path, "/zones/"):
+				fmt.Fprint(w, `{"defaultServiceAccount": "default-sa@project.iam.gserviceaccount.com"}`)
+			default:
+				http.NotFound(w, r)
+			}
+		})
+		g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+		_, err := g.createGCEInstance(&internalGCEImage{image: "cos-stable", project: "cos-cloud"})
+		if err == nil {
+			t.Fatal("expected creation to fail on quota errors")
+		}
+		if inserts != 1 {
+			t.Errorf("expected a single insert attempt for quota errors, got %d", inserts)
+		}
+	})
+}
+
+func TestCreateGCEInstanceDryRun(t *testing.T) {
+	oldZone, oldDryRun := *zone, *dryRun
+	defer func() { *zone, *dryRun = oldZone, oldDryRun }()
+	*zone = "us-west1-b"
+	*dryRun = true
+
+	inserts := 0
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/instances"):
+			inserts++
+			fmt.Fprint(w, `{"name": "op"}`)
+		case strings.Contains(r.URL.Path, "/projects/") && !strings.Contains(r.URL.Path, "/zones/"):
+			fmt.Fprint(w, `{"defaultServiceAccount": "default-sa@project.iam.gserviceaccount.com"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	_, err := g.createGCEInstance(&internalGCEImage{image: "cos-stable", project: "cos-cloud"})
+	if !errors.Is(err, errDryRun) {
+		t.Fatalf("expected the dry-run sentinel error, got: %v", err)
+	}
+	if inserts != 0 {
+		t.Errorf("expected no Instances.Insert call in dry-run mode, got %d", inserts)
+	}
+}
+
+func TestReuseInstances(t *testing.T) {
+	oldZone, oldReuse, oldDelay, oldSSH := *zone, *reuseInstances, *initialReadinessDelay, instanceUpSSH
+	defer func() {
+		*zone, *reuseInstances, *initialReadinessDelay, instanceUpSSH = oldZone, oldReuse, oldDelay, oldSSH
+	}()
+	*zone = "us-west1-b"
+	*reuseInstances = true
+	*initialReadinessDelay = 0
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		return "containerd.service running", nil
+	}
+
+	inserts, operations := 0, 0
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/instances"):
+			inserts++
+			fmt.Fprint(w, `{"name": "op"}`)
+		case strings.Contains(r.URL.Path, "/operations/"):
+			operations++
+			fmt.Fprint(w, `{"status": "DONE"}`)
+		case strings.Contains(r.URL.Path, "/instances/"):
+			fmt.Fprint(w, `{"name": "existing-instance", "status": "RUNNING"}`)
+		case strings.Contains(r.URL.Path, "/projects/") && !strings.Contains(r.URL.Path, "/zones/"):
+			fmt.Fprint(w, `{"defaultServiceAccount": "default-sa@project.iam.gserviceaccount.com"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	host, err := g.createGCEInstance(&internalGCEImage{image: "cos-stable", project: "cos-cloud"})
+	if err != nil {
+		t.Fatalf("expected reuse of the existing instance to succeed, got: %v", err)
+	}
+	if inserts != 0 {
+		t.Errorf("expected no Instances.Insert call when reusing, got %d", inserts)
+	}
+	if operations != 0 {
+		t.Errorf("expected no zone-operation polls when reusing, got %d", operations)
+	}
+	if !g.instanceReused(host) {
+		t.Errorf("expected instance %q to be marked as reused", host)
+	}
+}
+
+func TestDeletionProtection(t *testing.T) {
+	oldZone, oldProtection, oldDelay, oldSSH := *zone, *deletionProtection, *initialReadinessDelay, instanceUpSSH
+	defer func() {
+		*zone, *deletionProtection, *initialReadinessDelay, instanceUpSSH = oldZone, oldProtection, oldDelay, oldSSH
+	}()
+	*zone = "us-west1-b"
+	*deletionProtection = true
+	*initialReadinessDelay = 0
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		return "containerd.service running", nil
+	}
+
+	inserted := false
+	var insertedInstance compute.Instance
+	protectionCleared := false
+	deleted := false
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/setDeletionProtection"):
+			protectionCleared = true
+			fmt.Fprint(w, `{"name": "protection-op"}`)
+		case r.Method == http.MethodDelete:
+			if !protectionCleared {
+				t.Error("expected deletion protection to be cleared before the delete")
+			}
+			deleted = true
+			fmt.Fprint(w, `{"name": "delete-op"}`)
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/instances"):
+			inserted = true
+			if err := json.NewDecoder(r.Body).Decode(&insertedInstance); err != nil {
+				t.Errorf("failed to decode inserted instance: %v", err)
+			}
+			fmt.Fprint(w, `{"name": "insert-op"}`)
+		case strings.Contains(r.URL.Path, "/operations/"):
+			fmt.Fprint(w, `{"status": "DONE"}`)
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/instances/"):
+			if !inserted {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `{"name": "test-instance", "status": "RUNNING"}`)
+		case strings.Contains(r.URL.Path, "/projects/") && !strings.Contains(r.URL.Path, "/zones/"):
+			fmt.Fprint(w, `{"defaultServiceAccount": "default-sa@project.iam.gserviceaccount.com"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	host, err := g.createGCEInstance(&internalGCEImage{image: "cos-stable", project: "cos-cloud"})
+	if err != nil {
+		t.Fatalf("expected instance creation to succeed, got: %v", err)
+	}
+	if !insertedInstance.DeletionProtection {
+		t.Error("expected the inserted instance to request deletion protection")
+	}
+
+	g.deleteGCEInstance(host)
+	if !protectionCleared || !deleted {
+		t.Errorf("expected the protection to be cleared and the instance deleted, got cleared=%v deleted=%v", protectionCleared, deleted)
+	}
+}
+
+func TestBootDiskLabels(t *testing.T) {
+	oldZone, oldDelay, oldSSH := *zone, *initialReadinessDelay, instanceUpSSH
+	oldDiskLabels, oldBuildID := *diskLabels, *buildID
+	defer func() {
+		*zone, *initialReadinessDelay, instanceUpSSH = oldZone, oldDelay, oldSSH
+		*diskLabels, *buildID = oldDiskLabels, oldBuildID
+	}()
+	*zone = "us-west1-b"
+	*initialReadinessDelay = 0
+	*diskLabels = "team=node,env=ci"
+	*buildID = ""
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		return "containerd.service running", nil
+	}
+
+	inserted := false
+	var insertedInstance compute.Instance
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/instances"):
+			inserted = true
+			if err := json.NewDecoder(r.Body).Decode(&insertedInstance); err != nil {
+				t.Errorf("failed to decode inserted instance: %v", err)
+			}
+			fmt.Fprint(w, `{"name": "insert-op"}`)
+		case strings.Contains(r.URL.Path, "/operations/"):
+			fmt.Fprint(w, `{"status": "DONE"}`)
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/instances/"):
+			if !inserted {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `{"name": "test-instance", "status": "RUNNING"}`)
+		case strings.Contains(r.URL.Path, "/projects/") && !strings.Contains(r.URL.Path, "/zones/"):
+			fmt.Fprint(w, `{"defaultServiceAccount": "default-sa@project.iam.gserviceaccount.com"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	if _, err := g.createGCEInstance(&internalGCEImage{image: "cos-stable", project: "cos-cloud"}); err != nil {
+		t.Fatalf("expected instance creation to succeed, got: %v", err)
+	}
+	if len(insertedInstance.Disks) == 0 || insertedInstance.Disks[0].InitializeParams == nil {
+		t.Fatalf("expected the inserted instance to carry boot disk initialize params, got %+v", insertedInstance.Disks)
+	}
+	want := map[string]string{"team": "node", "env": "ci"}
+	if got := insertedInstance.Disks[0].InitializeParams.Labels; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the --disk-labels on the boot disk initialize params, got %v", got)
+	}
+
+	// Without the flag the boot disk inherits the instance labels.
+	*diskLabels = ""
+	labels, err := bootDiskLabels(map[string]string{buildIDKey: "build-42"})
+	if err != nil {
+		t.Fatalf("expected the fallback to the instance labels to succeed, got: %v", err)
+	}
+	if labels[buildIDKey] != "build-42" {
+		t.Errorf("expected the boot disk to inherit the instance labels, got %v", labels)
+	}
+
+	*diskLabels = "missing-value"
+	if _, err := bootDiskLabels(nil); err == nil || !strings.Contains(err.Error(), "invalid --disk-labels") {
+		t.Errorf("expected a malformed --disk-labels to be rejected, got: %v", err)
+	}
+}
+
+func TestRegionalBootDiskLabels(t *testing.T) {
+	oldDiskLabels, oldBuildID := *diskLabels, *buildID
+	defer func() { *diskLabels, *buildID = oldDiskLabels, oldBuildID }()
+	*diskLabels = "team=node,env=ci"
+	*buildID = ""
+
+	var insertedDisk compute.Disk
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/disks"):
+			if err := json.NewDecoder(r.Body).Decode(&insertedDisk); err != nil {
+				t.Errorf("failed to decode inserted disk: %v", err)
+			}
+			fmt.Fprint(w, `{"name": "disk-insert-op"}`)
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/disks/"):
+			fmt.Fprint(w, `{"status": "READY"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+	imageConfig := &internalGCEImage{image: "cos-stable", project: "cos-cloud", zone: "us-west1-b"}
+
+	if _, err := g.createRegionalBootDisk("test-instance", imageConfig); err != nil {
+		t.Fatalf("expected regional boot disk creation to succeed, got: %v", err)
+	}
+	want := map[string]string{"team": "node", "env": "ci"}
+	if !reflect.DeepEqual(insertedDisk.Labels, want) {
+		t.Errorf("expected the --disk-labels on the regional boot disk, got %v", insertedDisk.Labels)
+	}
+
+	// Without the flag the regional boot disk inherits the instance labels.
+	*diskLabels = ""
+	*buildID = "build-42"
+	insertedDisk = compute.Disk{}
+	if _, err := g.createRegionalBootDisk("test-instance", imageConfig); err != nil {
+		t.Fatalf("expected regional boot disk creation to succeed, got: %v", err)
+	}
+	if insertedDisk.Labels[buildIDKey] != "build-42" {
+		t.Errorf("expected the regional boot disk to inherit the instance labels, got %v", insertedDisk.Labels)
+	}
+}
+
+func TestZoneFallbackDoesNotDuplicateMetadata(t *testing.T) {
+	oldZone, oldZones, oldDelay, oldSSH := *zone, *zones, *initialReadinessDelay, instanceUpSSH
+	oldSerial := *enableSerialConsole
+	defer func() {
+		*zone, *zones, *initialReadinessDelay, instanceUpSSH = oldZone, oldZones, oldDelay, oldSSH
+		*enableSerialConsole = oldSerial
+	}()
+	*zone = ""
+	*zones = "us-west1-a,us-west1-b"
+	*initialReadinessDelay = 0
+	*enableSerialConsole = true
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		return "containerd.service running", nil
+	}
+
+	// The first zone is out of capacity; the second attempt reuses the same
+	// imageConfig and must not submit metadata keys twice.
+	inserted := false
+	var insertedInstance compute.Instance
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/instances"):
+			if strings.Contains(r.URL.Path, "/zones/us-west1-a/") {
+				fmt.Fprint(w, `{"name": "insert-op", "error": {"errors": [{"code": "ZONE_RESOURCE_POOL_EXHAUSTED"}]}}`)
+				return
+			}
+			inserted = true
+			if err := json.NewDecoder(r.Body).Decode(&insertedInstance); err != nil {
+				t.Errorf("failed to decode inserted instance: %v", err)
+			}
+			fmt.Fprint(w, `{"name": "insert-op"}`)
+		case strings.Contains(r.URL.Path, "/operations/"):
+			fmt.Fprint(w, `{"status": "DONE"}`)
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/instances/"):
+			if !inserted {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `{"name": "test-instance", "status": "RUNNING"}`)
+		case strings.Contains(r.URL.Path, "/projects/") && !strings.Contains(r.URL.Path, "/zones/"):
+			fmt.Fprint(w, `{"defaultServiceAccount": "default-sa@project.iam.gserviceaccount.com"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	configured := "v=1"
+	imageConfig := &internalGCEImage{
+		image:    "cos-stable",
+		project:  "cos-cloud",
+		metadata: &compute.Metadata{Items: []*compute.MetadataItems{{Key: "extra-config", Value: &configured}}},
+	}
+	if _, err := g.createGCEInstance(imageConfig); err != nil {
+		t.Fatalf("expected the zone fallback to succeed, got: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, item := range insertedInstance.Metadata.Items {
+		counts[item.Key]++
+	}
+	for key, count := range counts {
+		if count > 1 {
+			t.Errorf("expected metadata key %q once on the fallback attempt, got %d", key, count)
+		}
+	}
+	// The shared per-image metadata must stay untouched.
+	if len(imageConfig.metadata.Items) != 1 || imageConfig.metadata.Items[0].Key != "extra-config" {
+		t.Errorf("expected the image metadata to be unmodified, got %+v", imageConfig.metadata.Items)
+	}
+}
+
+func TestInsertOperationErrorNotMaskedByTransientError(t *testing.T) {
+	oldZone, oldTimeout := *zone, *instanceUpTimeout
+	defer func() { *zone, *instanceUpTimeout = oldZone, oldTimeout }()
+	*zone = "us-west1-b"
+	*instanceUpTimeout = 30 * time.Second
+
+	// The insert operation is still RUNNING on the first poll and completes
+	// DONE with a stockout error on the second; the stockout must be returned
+	// rather than the stale not-DONE error from the first iteration.
+	operationPolls := 0
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/operations/"):
+			operationPolls++
+			if operationPolls == 1 {
+				fmt.Fprint(w, `{"status": "RUNNING"}`)
+				return
+			}
+			fmt.Fprint(w, `{"status": "DONE", "error": {"errors": [{"code": "ZONE_RESOURCE_POOL_EXHAUSTED"}]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	_, err := g.waitForInstanceUp("test-instance", "us-west1-b", "insert-op")
+	if err == nil || !strings.Contains(err.Error(), "ZONE_RESOURCE_POOL_EXHAUSTED") {
+		t.Fatalf("expected the operation error to be surfaced, got: %v", err)
+	}
+	if strings.Contains(err.Error(), "was RUNNING") {
+		t.Errorf("expected the stale transient error not to mask the operation error, got: %v", err)
+	}
+	if !isZoneStockout(err) {
+		t.Errorf("expected the surfaced error to register as a zone stockout, got: %v", err)
+	}
+}
+
+func TestProvisionBackoffBoundedByTimeout(t *testing.T) {
+	if b := provisionBackoff(10 * time.Minute); b.Jitter == 0 {
+		t.Error("expected the provisioning backoff to jitter, so parallel instances don't poll in lockstep")
+	} else if b.Cap != provisionPollInterval {
+		t.Errorf("expected the backoff to be capped at the old fixed interval, got %v", b.Cap)
+	}
+
+	oldTimeout := *instanceUpTimeout
+	defer func() { *instanceUpTimeout = oldTimeout }()
+	*instanceUpTimeout = 50 * time.Millisecond
+
+	// The instance never reaches RUNNING; the poll must give up when
+	// --instance-up-timeout expires instead of finishing a full backoff step.
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "test-instance", "status": "PROVISIONING"}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	start := time.Now()
+	_, err := g.waitForInstanceUp("test-instance", "us-west1-b", "")
+	if err == nil {
+		t.Fatal("expected the poll to fail for an instance that never reaches RUNNING")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected the poll to stop at the configured timeout, took %v", elapsed)
+	}
+}
+
+func TestImageSupportsGVNIC(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		features string
+		want     bool
+	}{
+		{"feature present", `[{"type": "GVNIC"}, {"type": "UEFI_COMPATIBLE"}]`, true},
+		{"feature missing", `[{"type": "UEFI_COMPATIBLE"}]`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"name": "cos-stable", "guestOsFeatures": %s}`, tc.features)
+			})
+			g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+			if got := g.imageSupportsGVNIC(&internalGCEImage{image: "cos-stable", project: "cos-cloud"}); got != tc.want {
+				t.Errorf("imageSupportsGVNIC() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSourceImage(t *testing.T) {
+	g := &GCERunner{cfg: remote.Config{}}
+	for _, tc := range []struct {
+		name  string
+		image string
+		want  string
+	}{
+		{"bare name", "cos-stable", "projects/cos-cloud/global/images/cos-stable"},
+		{"projects form", "projects/other-project/global/images/custom-image", "projects/other-project/global/images/custom-image"},
+		{"full url", "https://www.googleapis.com/compute/v1/projects/other-project/global/images/custom-image", "https://www.googleapis.com/compute/v1/projects/other-project/global/images/custom-image"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := g.sourceImage(tc.image, "cos-cloud"); got != tc.want {
+				t.Errorf("sourceImage(%q) = %q, want %q", tc.image, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInstanceNetworkInterface(t *testing.T) {
+	oldStackType := *stackType
+	defer func() { *stackType = oldStackType }()
+
+	t.Run("ipv4 only", func(t *testing.T) {
+		*stackType = stackTypeIPv4Only
+		ni := instanceNetworkInterface()
+		if ni.StackType != "" {
+			t.Errorf("expected no stack type on an IPv4-only interface, got %q", ni.StackType)
+		}
+		if len(ni.Ipv6AccessConfigs) != 0 {
+			t.Errorf("expected no IPv6 access configs on an IPv4-only interface, got %d", len(ni.Ipv6AccessConfigs))
+		}
+		if len(ni.AccessConfigs) != 1 || ni.AccessConfigs[0].Type != "ONE_TO_ONE_NAT" {
+			t.Errorf("expected a single IPv4 NAT access config, got %+v", ni.AccessConfigs)
+		}
+	})
+	t.Run("dual stack", func(t *testing.T) {
+		*stackType = stackTypeDualStack
+		ni := instanceNetworkInterface()
+		if ni.StackType != stackTypeDualStack {
+			t.Errorf("expected stack type %q, got %q", stackTypeDualStack, ni.StackType)
+		}
+		if len(ni.Ipv6AccessConfigs) != 1 || ni.Ipv6AccessConfigs[0].Type != "DIRECT_IPV6" {
+			t.Errorf("expected a DIRECT_IPV6 access config, got %+v", ni.Ipv6AccessConfigs)
+		}
+		if len(ni.AccessConfigs) != 1 {
+			t.Errorf("expected the IPv4 NAT access config to be kept, got %+v", ni.AccessConfigs)
+		}
+	})
+}
+
+func TestGetExternalIPIPv6Fallback(t *testing.T) {
+	g := &GCERunner{}
+	instance := &compute.Instance{
+		NetworkInterfaces: []*compute.NetworkInterface{
+			{
+				Ipv6AccessConfigs: []*compute.AccessConfig{
+					{ExternalIpv6: "2600:1900::1"},
+				},
+			},
+		},
+	}
+	if got := g.getExternalIP(instance); got != "2600:1900::1" {
+		t.Errorf("expected the external IPv6 address as fallback, got %q", got)
+	}
+	instance.NetworkInterfaces[0].AccessConfigs = []*compute.AccessConfig{{NatIP: "1.2.3.4"}}
+	if got := g.getExternalIP(instance); got != "1.2.3.4" {
+		t.Errorf("expected the IPv4 NAT address to take precedence, got %q", got)
+	}
+}
+
+func TestApplyAdvancedMachineFeaturesNestedVirt(t *testing.T) {
+	oldNested := *enableNestedVirtualization
+	defer func() { *enableNestedVirtualization = oldNested }()
+
+	*enableNestedVirtualization = false
+	i := &compute.Instance{}
+	applyAdvancedMachineFeatures(i)
+	if i.AdvancedMachineFeatures != nil {
+		t.Errorf("expected no advanced machine features by default, got %+v", i.AdvancedMachineFeatures)
+	}
+
+	*enableNestedVirtualization = true
+	applyAdvancedMachineFeatures(i)
+	if i.AdvancedMachineFeatures == nil || !i.AdvancedMachineFeatures.EnableNestedVirtualization {
+		t.Errorf("expected nested virtualization to be enabled, got %+v", i.AdvancedMachineFeatures)
+	}
+}
+
+func TestApplyAdvancedMachineFeaturesSMT(t *testing.T) {
+	oldThreads, oldCores := *threadsPerCore, *visibleCoreCount
+	defer func() { *threadsPerCore, *visibleCoreCount = oldThreads, oldCores }()
+	*threadsPerCore = 1
+	*visibleCoreCount = 2
+
+	i := &compute.Instance{MachineType: "zones/us-west1-b/machineTypes/n2-standard-4"}
+	applyAdvancedMachineFeatures(i)
+	if i.AdvancedMachineFeatures == nil {
+		t.Fatal("expected advanced machine features to be populated")
+	}
+	if i.AdvancedMachineFeatures.ThreadsPerCore != 1 {
+		t.Errorf("expected threads per core 1, got %d", i.AdvancedMachineFeatures.ThreadsPerCore)
+	}
+	if i.AdvancedMachineFeatures.VisibleCoreCount != 2 {
+		t.Errorf("expected visible core count 2, got %d", i.AdvancedMachineFeatures.VisibleCoreCount)
+	}
+	if i.AdvancedMachineFeatures.EnableNestedVirtualization {
+		t.Error("expected nested virtualization to stay disabled")
+	}
+}
+
+func TestApplyNodeAffinitiesWithGPUScheduling(t *testing.T) {
+	oldAffinities := nodeAffinities
+	defer func() { nodeAffinities = oldAffinities }()
+	nodeAffinities = nil
+	if err := nodeAffinities.Set("workload=licensed"); err != nil {
+		t.Fatalf("failed to set node affinity: %v", err)
+	}
+
+	// The accelerator path sets on-host-maintenance TERMINATE; node affinity
+	// must compose with it rather than clobber it.
+	autoRestart := true
+	scheduling := &compute.Scheduling{
+		OnHostMaintenance: "TERMINATE",
+		AutomaticRestart:  &autoRestart,
+	}
+	applyNodeAffinities(scheduling)
+
+	if scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("expected on-host-maintenance TERMINATE to be preserved, got %q", scheduling.OnHostMaintenance)
+	}
+	if len(scheduling.NodeAffinities) != 1 {
+		t.Fatalf("expected 1 node affinity, got %d", len(scheduling.NodeAffinities))
+	}
+	na := scheduling.NodeAffinities[0]
+	if na.Key != "workload" || na.Operator != "IN" || !reflect.DeepEqual(na.Values, []string{"licensed"}) {
+		t.Errorf("unexpected node affinity %+v", na)
+	}
+
+	if err := nodeAffinities.Set("no-value"); err == nil {
+		t.Error("expected an error for a node affinity without '='")
+	}
+}
+
+func TestReplicaZonesForZone(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		zone    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "sibling a", zone: "us-west1-b", want: []string{"us-west1-b", "us-west1-a"}},
+		{name: "sibling b when zone is a", zone: "us-west1-a", want: []string{"us-west1-a", "us-west1-b"}},
+		{name: "no zone suffix", zone: "uswest1", wantErr: true},
+		{name: "trailing dash", zone: "us-west1-", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := replicaZonesForZone(tc.zone)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error for zone %q, got %v", tc.zone, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("replicaZonesForZone(%q) = %v, want %v", tc.zone, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegionFromZone(t *testing.T) {
+	for _, tc := range []struct {
+		zone    string
+		want    string
+		wantErr bool
+	}{
+		{zone: "europe-west1-b", want: "europe-west1"},
+		{zone: "europe-west4-c", want: "europe-west4"},
+		{zone: "us-central1-a", want: "us-central1"},
+		{zone: "asia-southeast1-f", want: "asia-southeast1"},
+		{zone: "invalid", wantErr: true},
+		{zone: "", wantErr: true},
+		{zone: "us-west1-", wantErr: true},
+		// A bare region must not be mis-split into a shorter region.
+		{zone: "us-west1", wantErr: true},
+		{zone: "-a", wantErr: true},
+	} {
+		t.Run(tc.zone, func(t *testing.T) {
+			region, err := regionFromZone(tc.zone)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("regionFromZone(%q) = %q, want an error", tc.zone, region)
+				}
+				return
+			}
+			if err != nil || region != tc.want {
+				t.Errorf("regionFromZone(%q) = %q, %v, want %q", tc.zone, region, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestShutdownDeletesTrackedInstances(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			parts := strings.Split(r.URL.Path, "/")
+			mu.Lock()
+			deleted = append(deleted, parts[len(parts)-1])
+			mu.Unlock()
+			fmt.Fprint(w, `{"name": "delete-operation"}`)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	g := &GCERunner{cfg: remote.Config{DeleteInstances: true}, gceComputeService: cs}
+	g.recordHostZone("instance-a", "us-west1-a")
+	g.recordHostZone("instance-b", "us-west1-b")
+	g.shutdown()
+
+	sort.Strings(deleted)
+	if want := []string{"instance-a", "instance-b"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("expected deletes for %v on shutdown, got %v", want, deleted)
+	}
+
+	deleted = nil
+	g = &GCERunner{cfg: remote.Config{DeleteInstances: false}, gceComputeService: cs}
+	g.recordHostZone("instance-c", "us-west1-a")
+	g.shutdown()
+	if len(deleted) != 0 {
+		t.Errorf("expected no deletes when --delete-instances is false, got %v", deleted)
+	}
+}
+
+func TestShutdownKeepsReusedAndKeptInstances(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			parts := strings.Split(r.URL.Path, "/")
+			mu.Lock()
+			deleted = append(deleted, parts[len(parts)-1])
+			mu.Unlock()
+			fmt.Fprint(w, `{"name": "delete-operation"}`)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	g := &GCERunner{cfg: remote.Config{DeleteInstances: true}, gceComputeService: cs}
+	g.recordHostZone("instance-created", "us-west1-a")
+	g.recordHostZone("instance-reused", "us-west1-a")
+	g.recordHostZone("instance-kept", "us-west1-b")
+	g.markInstanceReused("instance-reused")
+	g.markHostKept("instance-kept")
+	g.shutdown()
+
+	if want := []string{"instance-created"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("expected shutdown to delete only %v, got %v", want, deleted)
+	}
+}
+
+func TestDeleteGCEInstanceWaitsForOperation(t *testing.T) {
+	oldWait := *waitForDelete
+	defer func() { *waitForDelete = oldWait }()
+	*waitForDelete = true
+
+	operationPolls := 0
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			fmt.Fprint(w, `{"name": "delete-operation"}`)
+		case strings.Contains(r.URL.Path, "/operations/"):
+			operationPolls++
+			if operationPolls == 1 {
+				fmt.Fprint(w, `{"name": "delete-operation", "status": "RUNNING"}`)
+				return
+			}
+			fmt.Fprint(w, `{"name": "delete-operation", "status": "DONE"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+	g.recordHostZone("test-instance", "us-west1-b")
+
+	g.deleteGCEInstance("test-instance")
+	if operationPolls < 2 {
+		t.Errorf("expected the delete operation to be polled until DONE, got %d polls", operationPolls)
+	}
+}
+
+func TestWithAPIRetries(t *testing.T) {
+	oldRetries := *apiRetries
+	defer func() { *apiRetries = oldRetries }()
+	*apiRetries = 3
+
+	t.Run("retryable 503 eventually succeeds", func(t *testing.T) {
+		attempts := 0
+		err := withAPIRetries(func() error {
+			attempts++
+			if attempts == 1 {
+				return &googleapi.Error{Code: 503, Message: "backend error"}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("expected the call to succeed after a transient error, got: %v", err)
+		}
+		if attempts != 2 {
+			t.Errorf("expected 2 attempts, got %d", attempts)
+		}
+	})
+	t.Run("non-retryable 403 fails fast", func(t *testing.T) {
+		attempts := 0
+		err := withAPIRetries(func() error {
+			attempts++
+			return &googleapi.Error{Code: 403, Message: "permission denied"}
+		})
+		if err == nil {
+			t.Fatal("expected the permission error to be returned")
+		}
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != 403 {
+			t.Errorf("expected the original 403 error, got: %v", err)
+		}
+		if attempts != 1 {
+			t.Errorf("expected a single attempt for a permanent error, got %d", attempts)
+		}
+	})
+	t.Run("rate limit reason is retryable", func(t *testing.T) {
+		err := &googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}
+		if !isRetryableAPIError(err) {
+			t.Error("expected rateLimitExceeded to be retryable")
+		}
+	})
+}
+
+func TestParseReservationAffinity(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		value   string
+		want    *compute.ReservationAffinity
+		wantErr bool
+	}{
+		{name: "empty keeps default", value: "", want: nil},
+		{name: "any", value: "any", want: &compute.ReservationAffinity{ConsumeReservationType: "ANY_RESERVATION"}},
+		{name: "none", value: "none", want: &compute.ReservationAffinity{ConsumeReservationType: "NO_RESERVATION"}},
+		{
+			name:  "specific",
+			value: "specific:gpu-capacity",
+			want: &compute.ReservationAffinity{
+				ConsumeReservationType: "SPECIFIC_RESERVATION",
+				Key:                    "compute.googleapis.com/reservation-name",
+				Values:                 []string{"gpu-capacity"},
+			},
+		},
+		{name: "specific without name", value: "specific:", wantErr: true},
+		{name: "unknown mode", value: "sometimes", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseReservationAffinity(tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error for %q, got %+v", tc.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseReservationAffinity(%q) = %+v, want %+v", tc.value, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeleteOrphanInstances(t *testing.T) {
+	oldZone, oldPrefix, oldSelector := *zone, *cleanupNamePrefix, *cleanupLabelSelector
+	defer func() { *zone, *cleanupNamePrefix, *cleanupLabelSelector = oldZone, oldPrefix, oldSelector }()
+	*zone = "us-west1-b"
+	*cleanupNamePrefix = "org-node-e2e-"
+	*cleanupLabelSelector = "run-id=run-42"
+
+	var deleted []string
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			parts := strings.Split(r.URL.Path, "/")
+			deleted = append(deleted, parts[len(parts)-1])
+			fmt.Fprint(w, `{}`)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/instances"):
+			fmt.Fprint(w, `{"items": [
+				{"name": "org-node-e2e-cos-stable", "labels": {"run-id": "run-42"}},
+				{"name": "org-node-e2e-ubuntu", "labels": {"run-id": "run-41"}},
+				{"name": "other-prefix-cos-stable", "labels": {"run-id": "run-42"}},
+				{"name": "org-node-e2e-no-labels"}
+			]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	if err := g.deleteOrphanInstances(); err != nil {
+		t.Fatalf("expected orphan cleanup to succeed, got: %v", err)
+	}
+	// Only instances matching both the name prefix and the run-id label may be
+	// deleted.
+	if !reflect.DeepEqual(deleted, []string{"org-node-e2e-cos-stable"}) {
+		t.Errorf("expected only the instance matching prefix and label to be deleted, got %v", deleted)
+	}
+}
+
+func TestRunImageJobs(t *testing.T) {
+	oldRun := runImageTest
+	defer func() { runImageTest = oldRun }()
+
+	// A panicking job still produces a result, so the caller draining the
+	// channel by count does not hang, and the worker goes on to later jobs.
+	var order []string
+	runImageTest = func(g *GCERunner, suite remote.TestSuite, archivePath string, image *internalGCEImage, junitFileName string) *remote.TestResult {
+		order = append(order, image.image)
+		if image.image == "panics" {
+			panic("boom")
+		}
+		return &remote.TestResult{Image: image.image, ExitOK: true}
+	}
+
+	jobs := make(chan imageJob, 3)
+	for _, image := range []string{"a-image", "panics", "z-image"} {
+		jobs <- imageJob{image: &internalGCEImage{image: image}, junitFileName: image}
+	}
+	close(jobs)
+
+	g := &GCERunner{cfg: remote.Config{}}
+	results := make(chan *remote.TestResult)
+	// A single worker drains the queue in order.
+	go g.runImageJobs(nil, "", jobs, results)
+
+	byImage := make(map[string]*remote.TestResult)
+	for i := 0; i < 3; i++ {
+		tr := <-results
+		byImage[tr.Image] = tr
+	}
+	if !reflect.DeepEqual(order, []string{"a-image", "panics", "z-image"}) {
+		t.Errorf("expected a single worker to process the queue in order, got %v", order)
+	}
+	if tr := byImage["panics"]; tr == nil || tr.Err == nil || !strings.Contains(tr.Err.Error(), "panicked while testing image panics") {
+		t.Errorf("expected an error result for the panicking image, got %+v", byImage["panics"])
+	}
+	for _, image := range []string{"a-image", "z-image"} {
+		if tr := byImage[image]; tr == nil || tr.Err != nil || !tr.ExitOK {
+			t.Errorf("expected a clean result for image %q, got %+v", image, byImage[image])
+		}
+	}
+}
+
+func TestImageJobPanicStillDeletesInstance(t *testing.T) {
+	resultsDir := t.TempDir()
+	if err := flag.Lookup("results-dir").Value.Set(resultsDir); err != nil {
+		t.Fatalf("failed to set results-dir: %v", err)
+	}
+	oldZone, oldDelay, oldSSH, oldRunRemote := *zone, *initialReadinessDelay, instanceUpSSH, runRemote
+	defer func() {
+		*zone, *initialReadinessDelay, instanceUpSSH, runRemote = oldZone, oldDelay, oldSSH, oldRunRemote
+	}()
+	*zone = "us-west1-b"
+	*initialReadinessDelay = 0
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		return "containerd.service running", nil
+	}
+	// The suite runner dies on a malformed response instead of returning.
+	runRemote = func(cfg remote.RunRemoteConfig) (string, bool, error) {
+		panic("malformed API response")
+	}
+
+	inserted, deleted := false, false
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			deleted = true
+			fmt.Fprint(w, `{"name": "delete-operation"}`)
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/instances"):
+			inserted = true
+			fmt.Fprint(w, `{"name": "insert-operation"}`)
+		case strings.Contains(r.URL.Path, "/operations/"):
+			fmt.Fprint(w, `{"status": "DONE"}`)
+		case strings.Contains(r.URL.Path, "/instances/"):
+			if !inserted {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `{"status": "RUNNING"}`)
+		case strings.Contains(r.URL.Path, "/projects/") && !strings.Contains(r.URL.Path, "/zones/"):
+			fmt.Fprint(w, `{"defaultServiceAccount": "default-sa@project.iam.gserviceaccount.com"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{
+		cfg:               remote.Config{InstanceNamePrefix: "panic-test", DeleteInstances: true},
+		gceComputeService: cs,
+	}
+
+	result := g.runImageJob(nil, "", imageJob{
+		image:         &internalGCEImage{image: "cos-stable", project: "cos-cloud"},
+		junitFileName: "cos-stable",
+	})
+	if result == nil || result.Err == nil || !strings.Contains(result.Err.Error(), "panicked while testing image cos-stable") {
+		t.Fatalf("expected an error result carrying the panic, got %+v", result)
+	}
+	if !deleted {
+		t.Error("expected the instance to be deleted when the suite runner panicked")
+	}
+}
+
+func TestStateJobPanicProducesResult(t *testing.T) {
+	oldRunRemote := runRemote
+	defer func() { runRemote = oldRunRemote }()
+	// The suite runner dies on a malformed response instead of returning.
+	runRemote = func(cfg remote.RunRemoteConfig) (string, bool, error) {
+		panic("malformed API response")
+	}
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status": "RUNNING"}`)
+	})
+
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+	instance := provisionedInstance{Host: "provisioned-host", Zone: "us-west1-b", Image: "cos-stable"}
+	result := g.runStateJob(nil, "", instance)
+	if result == nil || result.Err == nil || !strings.Contains(result.Err.Error(), "panicked while testing instance provisioned-host") {
+		t.Fatalf("expected an error result carrying the panic, got %+v", result)
+	}
+	if result.Image != "cos-stable" {
+		t.Errorf("expected the result to carry the image name, got %+v", result)
+	}
+}
+
+func TestProvisionOnlySkipsRunRemote(t *testing.T) {
+	oldZone, oldDelay, oldSSH, oldRunRemote := *zone, *initialReadinessDelay, instanceUpSSH, runRemote
+	oldProvisionOnly, oldStateFile := *provisionOnly, *instanceStateFile
+	defer func() {
+		*zone, *initialReadinessDelay, instanceUpSSH, runRemote = oldZone, oldDelay, oldSSH, oldRunRemote
+		*provisionOnly, *instanceStateFile = oldProvisionOnly, oldStateFile
+	}()
+	*zone = "us-west1-b"
+	*initialReadinessDelay = 0
+	*provisionOnly = true
+	*instanceStateFile = filepath.Join(t.TempDir(), "state.json")
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		return "containerd.service running", nil
+	}
+	runRemoteCalls := 0
+	runRemote = func(cfg remote.RunRemoteConfig) (string, bool, error) {
+		runRemoteCalls++
+		return "", true, nil
+	}
+
+	inserted, deleted := false, false
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			deleted = true
+			fmt.Fprint(w, `{"name": "delete-operation"}`)
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/instances"):
+			inserted = true
+			fmt.Fprint(w, `{"name": "insert-operation"}`)
+		case strings.Contains(r.URL.Path, "/operations/"):
+			fmt.Fprint(w, `{"status": "DONE"}`)
+		case strings.Contains(r.URL.Path, "/instances/"):
+			if !inserted {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `{"status": "RUNNING"}`)
+		case strings.Contains(r.URL.Path, "/projects/") && !strings.Contains(r.URL.Path, "/zones/"):
+			fmt.Fprint(w, `{"defaultServiceAccount": "default-sa@project.iam.gserviceaccount.com"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{
+		cfg:               remote.Config{InstanceNamePrefix: "prov-test", DeleteInstances: true},
+		gceComputeService: cs,
+	}
+
+	result := g.runImageJob(nil, "", imageJob{
+		image:         &internalGCEImage{image: "cos-stable", project: "cos-cloud"},
+		junitFileName: "cos-stable",
+	})
+	if result.Err != nil || !result.ExitOK {
+		t.Fatalf("expected a clean provision-only result, got %+v", result)
+	}
+	if runRemoteCalls != 0 {
+		t.Errorf("expected no RunRemote call in provision-only mode, got %d", runRemoteCalls)
+	}
+	if deleted {
+		t.Error("expected the provisioned instance to be kept")
+	}
+	if !strings.Contains(result.Output, "ssh ") || !strings.Contains(result.Output, "prov-test-cos-stable") {
+		t.Errorf("expected a ready-to-paste SSH command in the output, got %q", result.Output)
+	}
+}
+
+func TestActiveHosts(t *testing.T) {
+	oldZone := *zone
+	defer func() { *zone = oldZone }()
+	*zone = "us-west1-b"
+
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "delete-operation", "status": "DONE"}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	if hosts := g.ActiveHosts(); len(hosts) != 0 {
+		t.Errorf("expected no active hosts initially, got %v", hosts)
+	}
+
+	g.recordHostZone("b-host", "us-west1-b")
+	g.recordHostZone("a-host", "us-west1-b")
+	if hosts := g.ActiveHosts(); !reflect.DeepEqual(hosts, []string{"a-host", "b-host"}) {
+		t.Errorf("expected the created hosts in sorted order, got %v", hosts)
+	}
+
+	// Deleting an instance drops it from the active list.
+	g.deleteGCEInstance("a-host")
+	if hosts := g.ActiveHosts(); !reflect.DeepEqual(hosts, []string{"b-host"}) {
+		t.Errorf("expected only the remaining host after deletion, got %v", hosts)
+	}
+}
+
+func TestDeleteOwnPrefixInstances(t *testing.T) {
+	oldZone := *zone
+	defer func() { *zone = oldZone }()
+	*zone = "us-west1-b"
+
+	var deleted []string
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			parts := strings.Split(r.URL.Path, "/")
+			deleted = append(deleted, parts[len(parts)-1])
+			fmt.Fprint(w, `{}`)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/instances"):
+			fmt.Fprint(w, `{"items": [
+				{"name": "tmp-node-e2e-abcd1234-cos-stable"},
+				{"name": "tmp-node-e2e-abcd1234-ubuntu"},
+				{"name": "tmp-node-e2e-ffff0000-cos-stable"},
+				{"name": "unrelated-instance"}
+			]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{cfg: remote.Config{InstanceNamePrefix: "tmp-node-e2e-abcd1234"}, gceComputeService: cs}
+
+	if err := g.deleteOwnPrefixInstances(); err != nil {
+		t.Fatalf("expected the prefix cleanup to succeed, got: %v", err)
+	}
+	// Only instances with this run's exact prefix may be deleted; other runs'
+	// instances stay untouched.
+	if !reflect.DeepEqual(deleted, []string{"tmp-node-e2e-abcd1234-cos-stable", "tmp-node-e2e-abcd1234-ubuntu"}) {
+		t.Errorf("expected only instances with our prefix to be deleted, got %v", deleted)
+	}
+
+	// An empty prefix must never turn into a delete-everything sweep.
+	g = &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+	if err := g.deleteOwnPrefixInstances(); err == nil {
+		t.Error("expected an error for an empty instance name prefix")
+	}
+}
+
+func TestParseLabelSelector(t *testing.T) {
+	labels, err := parseLabelSelector("run-id=run-42,job=node-e2e")
+	if err != nil {
+		t.Fatalf("expected selector to parse, got: %v", err)
+	}
+	if !reflect.DeepEqual(labels, map[string]string{"run-id": "run-42", "job": "node-e2e"}) {
+		t.Errorf("unexpected labels: %v", labels)
+	}
+	if _, err := parseLabelSelector("missing-value"); err == nil {
+		t.Error("expected a selector entry without '=' to be rejected")
+	}
+}
+
+func TestValidateAllowedZones(t *testing.T) {
+	oldZone, oldZones, oldAllowed := *zone, *zones, *allowedZones
+	defer func() { *zone, *zones, *allowedZones = oldZone, oldZones, oldAllowed }()
+
+	*zone = "us-west1-b"
+	*zones = ""
+	*allowedZones = ""
+	if err := validateAllowedZones(); err != nil {
+		t.Errorf("expected an empty allowlist to be unrestricted, got: %v", err)
+	}
+
+	*allowedZones = "us-west1-a,us-west1-b"
+	if err := validateAllowedZones(); err != nil {
+		t.Errorf("expected an allowlisted zone to pass, got: %v", err)
+	}
+
+	*zones = "us-west1-a,europe-west4-a"
+	if err := validateAllowedZones(); err == nil {
+		t.Error("expected an off-list zone in --zones to be rejected")
+	}
+
+	*zones = ""
+	*zone = "europe-west4-a"
+	if err := validateAllowedZones(); err == nil {
+		t.Error("expected an off-list --zone to be rejected")
+	}
+}
+
+func TestProvisionStateRoundTrip(t *testing.T) {
+	oldStateFile := *instanceStateFile
+	defer func() { *instanceStateFile = oldStateFile }()
+	*instanceStateFile = filepath.Join(t.TempDir(), "instances.json")
+
+	// Provision-only records instances one by one; test-from-state must read
+	// back exactly what was recorded.
+	g := &GCERunner{cfg: remote.Config{}}
+	want := []provisionedInstance{
+		{Host: "tmp-node-e2e-abcd1234-cos-stable", Zone: "us-west1-a", Image: "cos-stable-109", ShortName: "cos-stable"},
+		{Host: "tmp-node-e2e-abcd1234-ubuntu", Zone: "us-west1-b", Image: "ubuntu-2204", ShortName: "ubuntu"},
+	}
+	for _, instance := range want {
+		if err := g.appendProvisionState(instance); err != nil {
+			t.Fatalf("failed to record instance %q: %v", instance.Host, err)
+		}
+	}
+
+	state, err := readProvisionState(*instanceStateFile)
+	if err != nil {
+		t.Fatalf("failed to read state file: %v", err)
+	}
+	if !reflect.DeepEqual(state.Instances, want) {
+		t.Errorf("state round-trip mismatch, got %+v, want %+v", state.Instances, want)
+	}
+}
+
+func TestApplyConfidentialCompute(t *testing.T) {
+	oldConfidential := *confidentialCompute
+	defer func() { *confidentialCompute = oldConfidential }()
+
+	*confidentialCompute = false
+	i := &compute.Instance{MachineType: "zones/us-west1-b/machineTypes/e2-medium"}
+	if err := applyConfidentialCompute(i); err != nil || i.ConfidentialInstanceConfig != nil {
+		t.Errorf("expected no confidential config when disabled, got %+v, %v", i.ConfidentialInstanceConfig, err)
+	}
+
+	*confidentialCompute = true
+	i = &compute.Instance{
+		MachineType: "zones/us-west1-b/machineTypes/n2d-standard-4",
+		Scheduling:  &compute.Scheduling{Preemptible: true},
+	}
+	if err := applyConfidentialCompute(i); err != nil {
+		t.Fatalf("expected Confidential VM to be supported on n2d, got: %v", err)
+	}
+	if i.ConfidentialInstanceConfig == nil || !i.ConfidentialInstanceConfig.EnableConfidentialCompute {
+		t.Errorf("expected EnableConfidentialCompute to be set, got %+v", i.ConfidentialInstanceConfig)
+	}
+	// GCE requires Confidential VM instances to terminate on host maintenance.
+	if i.Scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("expected on-host-maintenance TERMINATE, got %q", i.Scheduling.OnHostMaintenance)
+	}
+
+	i = &compute.Instance{MachineType: "zones/us-west1-b/machineTypes/e2-medium"}
+	if err := applyConfidentialCompute(i); err == nil {
+		t.Error("expected Confidential VM to be rejected on e2 machine types")
+	}
+}
+
+func TestBootTimeMeasurement(t *testing.T) {
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	g := &GCERunner{cfg: remote.Config{}, clock: fakeClock}
+
+	// The insert operation takes 5 minutes before it is first observed DONE;
+	// that time must not count towards the boot measurement.
+	fakeClock.SetTime(fakeClock.Now().Add(5 * time.Minute))
+	g.markInstanceBooting("test-instance")
+	// Subsequent poll iterations re-observe DONE and must not reset the start.
+	fakeClock.SetTime(fakeClock.Now().Add(30 * time.Second))
+	g.markInstanceBooting("test-instance")
+	fakeClock.SetTime(fakeClock.Now().Add(90 * time.Second))
+	g.markInstanceBooted("test-instance")
+
+	if got := g.hostBootTime("test-instance"); got != 2*time.Minute {
+		t.Errorf("hostBootTime() = %v, want 2m excluding the insert-operation time", got)
+	}
+	if got := g.hostBootTime("unknown-instance"); got != 0 {
+		t.Errorf("hostBootTime(unknown-instance) = %v, want 0", got)
+	}
+}
+
+func TestHostZone(t *testing.T) {
+	oldZone := *zone
+	defer func() { *zone = oldZone }()
+	*zone = "us-central1-a"
+
+	g := &GCERunner{cfg: remote.Config{}}
+	g.recordHostZone("host-a", "us-west1-b")
+
+	if got := g.hostZone("host-a"); got != "us-west1-b" {
+		t.Errorf("hostZone(host-a) = %q, want us-west1-b", got)
+	}
+	if got := g.hostZone("unknown-host"); got != "us-central1-a" {
+		t.Errorf("hostZone(unknown-host) = %q, want the global zone us-central1-a", got)
+	}
+}
+
+func TestComputeServiceOptions(t *testing.T) {
+	t.Run("credentials file", func(t *testing.T) {
+		oldCredentialsFile := *gcpCredentialsFile
+		defer func() { *gcpCredentialsFile = oldCredentialsFile }()
+		*gcpCredentialsFile = "/path/to/key.json"
+
+		opts, err := computeServiceOptions()
+		if err != nil {
+			t.Fatalf("expected options to be built, got: %v", err)
+		}
+		if len(opts) != 1 || !reflect.DeepEqual(opts[0], option.WithCredentialsFile("/path/to/key.json")) {
+			t.Errorf("expected a single WithCredentialsFile option, got %v", opts)
+		}
+	})
+
+	t.Run("impersonation with missing source credentials", func(t *testing.T) {
+		oldCredentialsFile, oldImpersonate := *gcpCredentialsFile, *impersonateServiceAccount
+		defer func() { *gcpCredentialsFile, *impersonateServiceAccount = oldCredentialsFile, oldImpersonate }()
+		*gcpCredentialsFile = filepath.Join(t.TempDir(), "does-not-exist.json")
+		*impersonateServiceAccount = "target-sa@project.iam.gserviceaccount.com"
+
+		_, err := computeServiceOptions()
+		if err == nil {
+			t.Fatal("expected impersonation with missing source credentials to fail")
+		}
+		if !strings.Contains(err.Error(), "impersonate") {
+			t.Errorf("expected a descriptive impersonation error, got: %v", err)
+		}
+	})
+}
+
+func TestValidateSSHKeys(t *testing.T) {
+	t.Run("missing public key file", func(t *testing.T) {
+		t.Setenv("GCE_SSH_PUBLIC_KEY_FILE", filepath.Join(t.TempDir(), "does-not-exist.pub"))
+		if err := validateSSHKeys(); err == nil {
+			t.Fatal("expected validation to fail for a missing public key file")
+		}
+	})
+
+	t.Run("readable public key file", func(t *testing.T) {
+		pubKeyFile := filepath.Join(t.TempDir(), "key.pub")
+		if err := os.WriteFile(pubKeyFile, []byte("ssh-rsa AAAA test"), 0644); err != nil {
+			t.Fatalf("failed to write public key file: %v", err)
+		}
+		t.Setenv("GCE_SSH_PUBLIC_KEY_FILE", pubKeyFile)
+		if err := validateSSHKeys(); err != nil {
+			t.Fatalf("expected validation to succeed, got: %v", err)
+		}
+	})
+}
+
+func TestShouldDeleteInstance(t *testing.T) {
+	boolPtr := func(b bool) *bool { return &b }
+	for _, tc := range []struct {
+		name           string
+		global         bool
+		deleteInstance *bool
+		want           bool
+	}{
+		{
+			name:   "global delete applies when unset",
+			global: true,
+			want:   true,
+		},
+		{
+			name:           "per-image false keeps the instance",
+			global:         true,
+			deleteInstance: boolPtr(false),
+			want:           false,
+		},
+		{
+			name:           "per-image true deletes the instance",
+			global:         false,
+			deleteInstance: boolPtr(true),
+			want:           true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &GCERunner{cfg: remote.Config{DeleteInstances: tc.global}}
+			imageConfig := &internalGCEImage{deleteInstance: tc.deleteInstance}
+			if got := g.shouldDeleteInstance(imageConfig); got != tc.want {
+				t.Errorf("shouldDeleteInstance() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInstanceServiceAccounts(t *testing.T) {
+	g := &GCERunner{cfg: remote.Config{}}
+
+	t.Run("default service account", func(t *testing.T) {
+		sas := g.instanceServiceAccounts(&internalGCEImage{}, "default-sa@project.iam.gserviceaccount.com")
+		if len(sas) != 1 {
+			t.Fatalf("expected 1 service account, got %d", len(sas))
+		}
+		if sas[0].Email != "default-sa@project.iam.gserviceaccount.com" {
+			t.Errorf("expected the default service account, got %q", sas[0].Email)
+		}
+		want := []string{
+			"https://www.googleapis.com/auth/logging.write",
+			"https://www.googleapis.com/auth/monitoring.write",
+			"https://www.googleapis.com/auth/devstorage.read_only",
+		}
+		if !reflect.DeepEqual(sas[0].Scopes, want) {
+			t.Errorf("expected the minimal default scope set, got %v", sas[0].Scopes)
+		}
+	})
+
+	t.Run("broad scopes opt-out", func(t *testing.T) {
+		oldBroad := *broadScopes
+		defer func() { *broadScopes = oldBroad }()
+		*broadScopes = true
+
+		sas := g.instanceServiceAccounts(&internalGCEImage{}, "default-sa@project.iam.gserviceaccount.com")
+		if len(sas[0].Scopes) != 1 || sas[0].Scopes[0] != "https://www.googleapis.com/auth/cloud-platform" {
+			t.Errorf("expected the cloud-platform scope under --broad-scopes, got %v", sas[0].Scopes)
+		}
+	})
+
+	t.Run("flag override", func(t *testing.T) {
+		oldSA, oldScopes := *serviceAccount, *serviceAccountScopes
+		defer func() { *serviceAccount, *serviceAccountScopes = oldSA, oldScopes }()
+		*serviceAccount = "test-sa@project.iam.gserviceaccount.com"
+		*serviceAccountScopes = "https://www.googleapis.com/auth/compute,https://www.googleapis.com/auth/devstorage.read_only"
+
+		sas := g.instanceServiceAccounts(&internalGCEImage{}, "default-sa@project.iam.gserviceaccount.com")
+		if sas[0].Email != "test-sa@project.iam.gserviceaccount.com" {
+			t.Errorf("expected the flag service account, got %q", sas[0].Email)
+		}
+		if len(sas[0].Scopes) != 2 {
+			t.Errorf("expected 2 scopes, got %v", sas[0].Scopes)
+		}
+	})
+
+	t.Run("per-image override", func(t *testing.T) {
+		imageConfig := &internalGCEImage{
+			serviceAccount:       "image-sa@project.iam.gserviceaccount.com",
+			serviceAccountScopes: []string{"https://www.googleapis.com/auth/compute"},
+		}
+		sas := g.instanceServiceAccounts(imageConfig, "default-sa@project.iam.gserviceaccount.com")
+		if sas[0].Email != "image-sa@project.iam.gserviceaccount.com" {
+			t.Errorf("expected the per-image service account, got %q", sas[0].Email)
+		}
+		if len(sas[0].Scopes) != 1 || sas[0].Scopes[0] != "https://www.googleapis.com/auth/compute" {
+			t.Errorf("expected the per-image scopes, got %v", sas[0].Scopes)
+		}
+	})
+}
+
+func TestAddReadinessMetadata(t *testing.T) {
+	metadata := addReadinessMetadata(nil)
+	items := map[string]string{}
+	for _, item := range metadata.Items {
+		items[item.Key] = *item.Value
+	}
+	if items["startup-script"] != readinessStartupScript {
+		t.Errorf("expected startup-script to contain the readiness script, got %q", items["startup-script"])
+	}
+	if items["enable-guest-attributes"] != "TRUE" {
+		t.Errorf("expected enable-guest-attributes=TRUE, got %q", items["enable-guest-attributes"])
+	}
+}
+
+func TestAddSerialConsoleMetadata(t *testing.T) {
+	metadata := addSerialConsoleMetadata(nil)
+	found := false
+	for _, item := range metadata.Items {
+		if item.Key == "serial-port-enable" && item.Value != nil && *item.Value == "TRUE" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected serial-port-enable=TRUE metadata, got %+v", metadata.Items)
+	}
+}
+
+func TestAddOpsAgentMetadata(t *testing.T) {
+	// Without existing metadata both agent keys are enabled.
+	metadata := addOpsAgentMetadata(nil)
+	got := make(map[string]string)
+	for _, item := range metadata.Items {
+		if item.Value != nil {
+			got[item.Key] = *item.Value
+		}
+	}
+	if got["google-logging-enabled"] != "true" || got["google-monitoring-enabled"] != "true" {
+		t.Errorf("expected both agent keys enabled, got %v", got)
+	}
+
+	// An existing startup-script is preserved, and a value the config already
+	// sets for an agent key wins.
+	script := "#!/bin/sh\necho hello"
+	disabled := "false"
+	metadata = addOpsAgentMetadata(&compute.Metadata{Items: []*compute.MetadataItems{
+		{Key: "startup-script", Value: &script},
+		{Key: "google-logging-enabled", Value: &disabled},
+	}})
+	got = make(map[string]string)
+	for _, item := range metadata.Items {
+		if item.Value != nil {
+			if _, seen := got[item.Key]; seen {
+				t.Errorf("expected key %q to appear once, got %+v", item.Key, metadata.Items)
+			}
+			got[item.Key] = *item.Value
+		}
+	}
+	if got["startup-script"] != script {
+		t.Errorf("expected the existing startup-script to be preserved, got %q", got["startup-script"])
+	}
+	if got["google-logging-enabled"] != "false" {
+		t.Errorf("expected the configured google-logging-enabled value to win, got %q", got["google-logging-enabled"])
+	}
+	if got["google-monitoring-enabled"] != "true" {
+		t.Errorf("expected google-monitoring-enabled to be added, got %v", got)
+	}
+}
+
+func TestWaitForReadinessAttribute(t *testing.T) {
+	oldTimeout := *cloudInitTimeout
+	defer func() { *cloudInitTimeout = oldTimeout }()
+	*cloudInitTimeout = 100 * time.Millisecond
+
+	polled := false
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/getGuestAttributes") {
+			http.NotFound(w, r)
+			return
+		}
+		polled = true
+		fmt.Fprint(w, `{"variableKey": "startup/status", "variableValue": "done"}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	if err := g.waitForReadinessAttribute("test-instance", "us-west1-b"); err != nil {
+		t.Fatalf("expected readiness wait to succeed, got: %v", err)
+	}
+	if !polled {
+		t.Error("expected the guest-attribute endpoint to be polled")
+	}
+}
+
+func TestPrepareGceImagesTOML(t *testing.T) {
+	oldProject, oldZone := *project, *zone
+	defer func() { *project, *zone = oldProject, oldZone }()
+	*project = "test-project"
+	*zone = "us-west1-b"
+
+	dir := t.TempDir()
+	yamlConfig := filepath.Join(dir, "image-config.yaml")
+	if err := os.WriteFile(yamlConfig, []byte(`images:
+  cos-stable:
+    image: cos-stable-109-17800-0-51
+    project: cos-cloud
+    machine: n1-standard-2
+    kernel_arguments:
+      - quiet
+`), 0644); err != nil {
+		t.Fatalf("failed to write yaml config: %v", err)
+	}
+	tomlConfig := filepath.Join(dir, "image-config.toml")
+	if err := os.WriteFile(tomlConfig, []byte(`[images.cos-stable]
+image = "cos-stable-109-17800-0-51"
+project = "cos-cloud"
+machine = "n1-standard-2"
+kernel_arguments = ["quiet"]
+`), 0644); err != nil {
+		t.Fatalf("failed to write toml config: %v", err)
+	}
+
+	fromYAML, err := (&GCERunner{cfg: remote.Config{ImageConfigFile: yamlConfig}}).prepareGceImages()
+	if err != nil {
+		t.Fatalf("failed to prepare images from yaml: %v", err)
+	}
+	fromTOML, err := (&GCERunner{cfg: remote.Config{ImageConfigFile: tomlConfig}}).prepareGceImages()
+	if err != nil {
+		t.Fatalf("failed to prepare images from toml: %v", err)
+	}
+	if !reflect.DeepEqual(fromYAML.images, fromTOML.images) {
+		t.Errorf("expected toml and yaml configs to parse identically, got %+v vs %+v", fromTOML.images, fromYAML.images)
+	}
+}
+
+func TestPrepareGceImagesImageProject(t *testing.T) {
+	oldProject, oldZone := *project, *zone
+	defer func() { *project, *zone = oldProject, oldZone }()
+	*project = "launch-project"
+	*zone = "us-west1-b"
+
+	configFile := filepath.Join(t.TempDir(), "image-config.yaml")
+	if err := os.WriteFile(configFile, []byte(`images:
+  cos-stable:
+    image: cos-stable-109-17800-0-51
+    project: launch-project
+    image_project: cos-cloud
+  ubuntu:
+    image: ubuntu-2204
+    project: ubuntu-os-cloud
+`), 0644); err != nil {
+		t.Fatalf("failed to write image config file: %v", err)
+	}
+	g := &GCERunner{cfg: remote.Config{ImageConfigFile: configFile}}
+
+	images, err := g.prepareGceImages()
+	if err != nil {
+		t.Fatalf("failed to prepare images: %v", err)
+	}
+	// image_project wins for image resolution when set; a single project keeps
+	// the old behavior.
+	if got := images.images["cos-stable"].project; got != "cos-cloud" {
+		t.Errorf("expected the cos-stable image to resolve from cos-cloud, got %q", got)
+	}
+	if got := images.images["ubuntu"].project; got != "ubuntu-os-cloud" {
+		t.Errorf("expected the ubuntu image to resolve from ubuntu-os-cloud, got %q", got)
+	}
+}
+
+func TestPrepareGceImagesEmptySet(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "image-config.yaml")
+	if err := os.WriteFile(configFile, []byte("images: {}\n"), 0644); err != nil {
+		t.Fatalf("failed to write image config file: %v", err)
+	}
+	g := &GCERunner{cfg: remote.Config{ImageConfigFile: configFile}}
+
+	_, err := g.prepareGceImages()
+	if err == nil {
+		t.Fatal("expected prepareGceImages to fail when no images resolve")
+	}
+	if !strings.Contains(err.Error(), "no images were resolved") {
+		t.Errorf("expected empty-image-set error, got: %v", err)
+	}
+}
+
+func TestGetComputeClientRetries(t *testing.T) {
+	oldRetries, oldBackoff := *computeClientRetries, *computeClientBackoff
+	defer func() { *computeClientRetries, *computeClientBackoff = oldRetries, oldBackoff }()
+	*computeClientRetries = 3
+	*computeClientBackoff = time.Millisecond
+
+	t.Run("succeeds after transient failures", func(t *testing.T) {
+		attempts := 0
+		cs, err := getComputeClient(func() (*compute.Service, error) {
+			attempts++
+			if attempts < 3 {
+				return nil, fmt.Errorf("transient failure %d", attempts)
+			}
+			return &compute.Service{}, nil
+		})
+		if err != nil {
+			t.Fatalf("expected client creation to succeed, got: %v", err)
+		}
+		if cs == nil {
+			t.Fatal("expected a non-nil compute service")
+		}
+		if attempts != 3 {
+			t.Errorf("expected 3 attempts, got %d", attempts)
+		}
+	})
+
+	t.Run("gives up after the configured retries", func(t *testing.T) {
+		attempts := 0
+		_, err := getComputeClient(func() (*compute.Service, error) {
+			attempts++
+			return nil, fmt.Errorf("persistent failure")
+		})
+		if err == nil {
+			t.Fatal("expected client creation to fail")
+		}
+		if attempts != 3 {
+			t.Errorf("expected 3 attempts, got %d", attempts)
+		}
+		if !strings.Contains(err.Error(), "after 3 attempts") || !strings.Contains(err.Error(), "persistent failure") {
+			t.Errorf("expected error wrapping the last failure with the attempt count, got: %v", err)
+		}
+	})
+}
+
+func TestGetZoneOperationRetriesTransientErrors(t *testing.T) {
+	requests := 0
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "transient backend error", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"name": "test-operation", "status": "DONE"}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	op, err := g.getZoneOperation("test-project", "us-west1-b", "test-operation")
+	if err != nil {
+		t.Fatalf("expected the operation fetch to succeed after a transient error, got: %v", err)
+	}
+	if op.Status != "DONE" {
+		t.Errorf("expected operation status DONE, got %q", op.Status)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestWaitForInstanceUpTimeout(t *testing.T) {
+	oldTimeout := *instanceUpTimeout
+	defer func() { *instanceUpTimeout = oldTimeout }()
+	*instanceUpTimeout = 100 * time.Millisecond
+
+	// The fake instance never leaves PROVISIONING, so the poll must give up
+	// once --instance-up-timeout expired.
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/operations/") {
+			fmt.Fprint(w, `{"status": "DONE"}`)
+			return
+		}
+		fmt.Fprint(w, `{"name": "test-instance", "status": "PROVISIONING"}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	start := time.Now()
+	_, err := g.waitForInstanceUp("test-instance", "us-west1-b", "test-operation")
+	if err == nil {
+		t.Fatal("expected waitForInstanceUp to fail for an instance that never becomes RUNNING")
+	}
+	if !strings.Contains(err.Error(), "not in state RUNNING") {
+		t.Errorf("expected error about instance state, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the poll to give up at the configured timeout, took %v", elapsed)
+	}
+}
+
+func TestInitialReadinessDelay(t *testing.T) {
+	oldDelay := *initialReadinessDelay
+	oldSSH := instanceUpSSH
+	oldSleep := readinessSleep
+	defer func() {
+		*initialReadinessDelay = oldDelay
+		instanceUpSSH = oldSSH
+		readinessSleep = oldSleep
+	}()
+	*initialReadinessDelay = 42 * time.Second
+
+	var events []string
+	readinessSleep = func(d time.Duration) {
+		events = append(events, fmt.Sprintf("sleep %v", d))
+	}
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		events = append(events, "ssh")
+		return "containerd.service running", nil
+	}
+
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/operations/") {
+			fmt.Fprint(w, `{"status": "DONE"}`)
+			return
+		}
+		fmt.Fprint(w, `{"name": "test-instance", "status": "RUNNING"}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	if _, err := g.waitForInstanceUp("test-instance", "us-west1-b", "test-operation"); err != nil {
+		t.Fatalf("expected waitForInstanceUp to succeed, got: %v", err)
+	}
+	if len(events) < 2 || events[0] != "sleep 42s" || events[1] != "ssh" {
+		t.Errorf("expected the initial readiness delay to elapse before the first SSH attempt, got events %v", events)
+	}
+}
+
+func TestRunTimeline(t *testing.T) {
+	resultsDir := t.TempDir()
+	if err := flag.Lookup("results-dir").Value.Set(resultsDir); err != nil {
+		t.Fatalf("failed to set results-dir: %v", err)
+	}
+	oldDelay := *initialReadinessDelay
+	oldSSH := instanceUpSSH
+	defer func() {
+		*initialReadinessDelay = oldDelay
+		instanceUpSSH = oldSSH
+	}()
+	*initialReadinessDelay = 0
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		return "containerd.service running", nil
+	}
+
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			fmt.Fprint(w, `{"name": "delete-operation"}`)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/operations/") {
+			fmt.Fprint(w, `{"status": "DONE"}`)
+			return
+		}
+		fmt.Fprint(w, `{"name": "test-instance", "status": "RUNNING"}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	// Replay the event hooks of one image run, driving the ones with fakeable
+	// dependencies for real.
+	g.recordEvent("test-instance", "insert-issued")
+	if _, err := g.waitForInstanceUp("test-instance", "us-west1-b", "test-operation"); err != nil {
+		t.Fatalf("expected waitForInstanceUp to succeed, got: %v", err)
+	}
+	g.recordEvent("test-instance", "test-start")
+	g.recordEvent("test-instance", "test-end")
+	g.deleteGCEInstance("test-instance")
+
+	if err := g.writeTimeline(); err != nil {
+		t.Fatalf("failed to write timeline: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(resultsDir, "timeline.json"))
+	if err != nil {
+		t.Fatalf("failed to read timeline.json: %v", err)
+	}
+	var timeline []timelineEvent
+	if err := json.Unmarshal(data, &timeline); err != nil {
+		t.Fatalf("failed to unmarshal timeline.json: %v", err)
+	}
+	var got []string
+	for _, ev := range timeline {
+		if ev.Host != "test-instance" {
+			t.Errorf("expected all events for host test-instance, got %q", ev.Host)
+		}
+		if ev.Time.IsZero() {
+			t.Errorf("expected event %q to carry a timestamp", ev.Event)
+		}
+		got = append(got, ev.Event)
+	}
+	want := []string{"insert-issued", "running", "ssh-ready", "test-start", "test-end", "deleted"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected timeline events %v, got %v", want, got)
+	}
+}
+
+func TestCollectInstanceMetadata(t *testing.T) {
+	resultsDir := t.TempDir()
+	if err := flag.Lookup("results-dir").Value.Set(resultsDir); err != nil {
+		t.Fatalf("failed to set results-dir: %v", err)
+	}
+
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "test-instance", "metadata": {"items": [
+			{"key": "user-data", "value": "#cloud-config"},
+			{"key": "gci-service-account-token", "value": "super-secret"}
+		]}}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+	g.recordHostZone("test-instance", "us-west1-b")
+
+	if err := g.collectInstanceMetadata("test-instance"); err != nil {
+		t.Fatalf("expected metadata collection to succeed, got: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(resultsDir, "test-instance", "instance-metadata.json"))
+	if err != nil {
+		t.Fatalf("failed to read metadata artifact: %v", err)
+	}
+	var items map[string]string
+	if err := json.Unmarshal(data, &items); err != nil {
+		t.Fatalf("failed to parse metadata artifact: %v", err)
+	}
+	if items["user-data"] != "#cloud-config" {
+		t.Errorf("expected plain metadata to be preserved, got %q", items["user-data"])
+	}
+	// Secret-looking keys must never end up in artifacts verbatim.
+	if items["gci-service-account-token"] != redactedMetadataValue {
+		t.Errorf("expected the token value to be redacted, got %q", items["gci-service-account-token"])
+	}
+}
+
+func TestInjectFiles(t *testing.T) {
+	oldManifest := *fileInjectManifest
+	defer func() { *fileInjectManifest = oldManifest }()
+
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "file-inject.yaml")
+	if err := os.WriteFile(manifest, []byte(`- local: `+filepath.Join(dir, "config.toml")+`
+  remote: /etc/containerd/config.toml
+- local: `+filepath.Join(dir, "cert.pem")+`
+  remote: /etc/ssl/cert.pem
+`), 0644); err != nil {
+		t.Fatalf("failed to write manifest: %v", err)
+	}
+	*fileInjectManifest = manifest
+
+	type copyCall struct{ local, remote string }
+	var copies []copyCall
+	oldCopy := copyFileToHost
+	defer func() { copyFileToHost = oldCopy }()
+	copyFileToHost = func(host, localPath, remotePath string) (string, error) {
+		copies = append(copies, copyCall{localPath, remotePath})
+		return "", nil
+	}
+
+	g := &GCERunner{cfg: remote.Config{}}
+	if err := g.injectFiles("test-instance"); err != nil {
+		t.Fatalf("expected file injection to succeed, got: %v", err)
+	}
+	want := []copyCall{
+		{filepath.Join(dir, "config.toml"), "/etc/containerd/config.toml"},
+		{filepath.Join(dir, "cert.pem"), "/etc/ssl/cert.pem"},
+	}
+	if !reflect.DeepEqual(copies, want) {
+		t.Errorf("expected both manifest entries to be transferred, got %+v, want %+v", copies, want)
+	}
+}
+
+func TestParseFileInjectManifest(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "file-inject.yaml")
+	if err := os.WriteFile(manifest, []byte("- local: /tmp/config.toml\n"), 0644); err != nil {
+		t.Fatalf("failed to write manifest: %v", err)
+	}
+	if _, err := parseFileInjectManifest(manifest); err == nil {
+		t.Error("expected an entry without a remote path to be rejected")
+	}
+}
+
+func TestSampleHostResources(t *testing.T) {
+	oldSSH := sampleSSH
+	defer func() { sampleSSH = oldSSH }()
+	sampleSSH = func(host string, cmd ...string) (string, error) {
+		if cmd[0] == "cat" {
+			return "1.52 0.87 0.34 2/345 6789\n", nil
+		}
+		return "MemTotal:       16384000 kB\nMemAvailable:   12288000 kB\n", nil
+	}
+
+	g := &GCERunner{cfg: remote.Config{}}
+	usage, err := g.sampleHostResources("test-instance")
+	if err != nil {
+		t.Fatalf("expected sampling to succeed, got: %v", err)
+	}
+	want := "load1=1.52 load5=0.87 load15=0.34 mem_total_kb=16384000 mem_available_kb=12288000"
+	if usage != want {
+		t.Errorf("sampleHostResources() = %q, want %q", usage, want)
+	}
+
+	sampleSSH = func(host string, cmd ...string) (string, error) {
+		return "garbage", nil
+	}
+	if _, err := g.sampleHostResources("test-instance"); err == nil {
+		t.Error("expected unparseable loadavg output to be rejected")
+	}
+}
+
+func TestGpuDriverInstallCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		image   string
+		version string
+		want    string
+	}{
+		{
+			name:    "pinned version flows into the install command",
+			image:   "cos-stable-109-17800-0-51",
+			version: "535.104.05",
+			want:    "cos-extensions install gpu -- -version=535.104.05",
+		},
+		{
+			name:  "empty version defaults to latest",
+			image: "cos-stable-109-17800-0-51",
+			want:  "cos-extensions install gpu",
+		},
+		{
+			name:    "ubuntu pins via ubuntu-drivers",
+			image:   "ubuntu-2204-lts",
+			version: "535",
+			want:    "ubuntu-drivers install --gpgpu nvidia:535",
+		},
+		{
+			name:  "ubuntu defaults to the recommended driver",
+			image: "ubuntu-2204-lts",
+			want:  "ubuntu-drivers install --gpgpu",
+		},
+		{
+			name:    "unsupported image has no install command",
+			image:   "fedora-coreos-38",
+			version: "535.104.05",
+			want:    "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := gpuDriverInstallCommand(tc.image, tc.version); got != tc.want {
+				t.Errorf("gpuDriverInstallCommand(%q, %q) = %q, want %q", tc.image, tc.version, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetGCEImageArchitectureFilter(t *testing.T) {
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/global/images") {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"items": [
+			{"name": "cos-stable-109-amd64", "creationTimestamp": "2023-03-01T00:00:00Z", "architecture": "X86_64"},
+			{"name": "cos-stable-109-arm64", "creationTimestamp": "2023-02-01T00:00:00Z", "architecture": "ARM64"}
+		]}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	// Even though the amd64 image is newer, an arm64 run must only consider
+	// arm64 images.
+	image, err := g.getGCEImage("cos-stable-.*", "", "arm64", "cos-cloud")
+	if err != nil {
+		t.Fatalf("expected image resolution to succeed, got: %v", err)
+	}
+	if image != "cos-stable-109-arm64" {
+		t.Errorf("expected the arm64 image, got %q", image)
+	}
+
+	image, err = g.getGCEImage("cos-stable-.*", "", "", "cos-cloud")
+	if err != nil {
+		t.Fatalf("expected image resolution to succeed, got: %v", err)
+	}
+	if image != "cos-stable-109-amd64" {
+		t.Errorf("expected the newest image without an architecture filter, got %q", image)
+	}
+}
+
+func TestPrepareGceImagesCachesResolution(t *testing.T) {
+	oldProject, oldZone := *project, *zone
+	defer func() { *project, *zone = oldProject, oldZone }()
+	*project = "test-project"
+	*zone = "us-west1-b"
+
+	listCalls := 0
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/global/images") {
+			http.NotFound(w, r)
+			return
+		}
+		listCalls++
+		fmt.Fprint(w, `{"items": [
+			{"name": "cos-stable-109-17800-0-51", "family": "cos-109-lts", "creationTimestamp": "2023-03-01T00:00:00Z"}
+		]}`)
+	})
+
+	configFile := filepath.Join(t.TempDir(), "image-config.yaml")
+	if err := os.WriteFile(configFile, []byte(`images:
+  cos-serial:
+    image_family: cos-109-lts
+    project: cos-cloud
+  cos-cgroupv2:
+    image_family: cos-109-lts
+    project: cos-cloud
+`), 0644); err != nil {
+		t.Fatalf("failed to write image config file: %v", err)
+	}
+	g := &GCERunner{cfg: remote.Config{ImageConfigFile: configFile}, gceComputeService: cs}
+
+	images, err := g.prepareGceImages()
+	if err != nil {
+		t.Fatalf("failed to prepare images: %v", err)
+	}
+	for _, shortName := range []string{"cos-serial", "cos-cgroupv2"} {
+		if got := images.images[shortName].image; got != "cos-stable-109-17800-0-51" {
+			t.Errorf("expected %s to resolve to the family image, got %q", shortName, got)
+		}
+	}
+	// Both entries share the same lookup, so only the first may hit the API.
+	if listCalls != 1 {
+		t.Errorf("expected a single Images.List call for identical lookups, got %d", listCalls)
+	}
+}
+
+func TestGetGCEImageRegexAndFamilyCombined(t *testing.T) {
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/global/images") {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"items": [
+			{"name": "cos-beta-113-1", "family": "cos-beta", "creationTimestamp": "2023-04-01T00:00:00Z"},
+			{"name": "cos-stable-109-2", "family": "cos-109-lts", "creationTimestamp": "2023-03-01T00:00:00Z"},
+			{"name": "cos-stable-109-1", "family": "cos-109-lts", "creationTimestamp": "2023-01-01T00:00:00Z"},
+			{"name": "cos-dev-109-9", "family": "cos-109-lts", "creationTimestamp": "2023-05-01T00:00:00Z", "deprecated": {"state": "DEPRECATED"}}
+		]}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	// Regex and family apply together: the newest image overall matches only
+	// the regex, the newest family member is deprecated, so the newest active
+	// image matching both must win.
+	image, err := g.getGCEImage("cos-.*-109-.*", "cos-109-lts", "", "cos-cloud")
+	if err != nil {
+		t.Fatalf("expected image resolution to succeed, got: %v", err)
+	}
+	if image != "cos-stable-109-2" {
+		t.Errorf("expected the newest active image matching regex and family, got %q", image)
+	}
+}
+
+func TestValidateImageConfigExplicitImagePrecedence(t *testing.T) {
+	// An explicit image alongside regex or family is an error rather than a
+	// silent override.
+	for _, tc := range []struct {
+		name    string
+		img     GCEImage
+		wantErr bool
+	}{
+		{name: "image only", img: GCEImage{Image: "cos-stable-109", Project: "cos-cloud"}},
+		{name: "regex and family", img: GCEImage{ImageRegex: "cos-.*", ImageFamily: "cos-109-lts", Project: "cos-cloud"}},
+		{name: "image with regex", img: GCEImage{Image: "cos-stable-109", ImageRegex: "cos-.*", Project: "cos-cloud"}, wantErr: true},
+		{name: "image with family", img: GCEImage{Image: "cos-stable-109", ImageFamily: "cos-109-lts", Project: "cos-cloud"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateImageConfig(&GCEImageConfig{Images: map[string]GCEImage{"img": tc.img}})
+			if tc.wantErr && err == nil {
+				t.Error("expected a validation error, got nil")
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("expected no validation error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateImageConfigAccelerators(t *testing.T) {
+	// A zero-count accelerator is rejected during config validation instead
+	// of surfacing as a late insert failure.
+	err := validateImageConfig(&GCEImageConfig{Images: map[string]GCEImage{
+		"zero-count": {
+			Image:     "cos-stable-109",
+			Project:   "cos-cloud",
+			Machine:   "n1-standard-8",
+			Resources: Resources{Accelerators: []Accelerator{{Type: "nvidia-tesla-t4", Count: 0}}},
+		},
+	}})
+	if err == nil || !strings.Contains(err.Error(), `zero-count: accelerator "nvidia-tesla-t4" count must be positive`) {
+		t.Errorf("expected a positive-count error, got: %v", err)
+	}
+
+	// Accelerators on a machine family that cannot carry them are rejected.
+	err = validateImageConfig(&GCEImageConfig{Images: map[string]GCEImage{
+		"bad-family": {
+			Image:     "cos-stable-109",
+			Project:   "cos-cloud",
+			Machine:   "e2-standard-8",
+			Resources: Resources{Accelerators: []Accelerator{{Type: "nvidia-tesla-t4", Count: 1}}},
+		},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "cannot have guest accelerators attached") {
+		t.Errorf("expected a GPU-capability error, got: %v", err)
+	}
+
+	// GPU-capable families pass.
+	for _, machine := range []string{"n1-standard-8", "a2-highgpu-1g", "g2-standard-4", "custom-6-20480", ""} {
+		err = validateImageConfig(&GCEImageConfig{Images: map[string]GCEImage{
+			"good": {
+				Image:     "cos-stable-109",
+				Project:   "cos-cloud",
+				Machine:   machine,
+				Resources: Resources{Accelerators: []Accelerator{{Type: "nvidia-tesla-t4", Count: 1}}},
+			},
+		}})
+		if err != nil {
+			t.Errorf("expected machine %q with accelerators to validate, got: %v", machine, err)
+		}
+	}
+}
+
+func TestPerImageLaunchProject(t *testing.T) {
+	oldProject, oldZone := *project, *zone
+	defer func() { *project, *zone = oldProject, oldZone }()
+	*project = "global-project"
+	*zone = "us-west1-b"
+
+	var deletePath string
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deletePath = r.URL.Path
+		}
+		fmt.Fprint(w, `{"name": "test-operation", "status": "DONE"}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+	g.recordHostZone("launch-project-host", "us-west1-b")
+	g.recordHostProject("launch-project-host", "other-project")
+
+	g.deleteGCEInstance("launch-project-host")
+	if !strings.Contains(deletePath, "/projects/other-project/zones/us-west1-b/instances/launch-project-host") {
+		t.Errorf("expected the delete to target the launch project, got path %q", deletePath)
+	}
+
+	// Hosts this runner did not create fall back to the global --project.
+	if got := g.hostProject("unknown-host"); got != "global-project" {
+		t.Errorf("expected the global project for unknown hosts, got %q", got)
+	}
+
+	// launch_project is threaded from the image config.
+	configFile := filepath.Join(t.TempDir(), "image-config.yaml")
+	if err := os.WriteFile(configFile, []byte(`images:
+  cos-stable:
+    image: cos-stable-109-17800-0-51
+    project: cos-cloud
+    launch_project: other-project
+`), 0644); err != nil {
+		t.Fatalf("failed to write image config: %v", err)
+	}
+	g.cfg.ImageConfigFile = configFile
+	images, err := g.prepareGceImages()
+	if err != nil {
+		t.Fatalf("expected image preparation to succeed, got: %v", err)
+	}
+	img := images.images["cos-stable"]
+	if img.launchProject != "other-project" {
+		t.Errorf("expected launch_project to be threaded through, got %q", img.launchProject)
+	}
+	if got := g.launchProject(&img); got != "other-project" {
+		t.Errorf("expected the per-image launch project, got %q", got)
+	}
+	if got := g.launchProject(&internalGCEImage{}); got != "global-project" {
+		t.Errorf("expected the global project as launch default, got %q", got)
+	}
+}
+
+func TestValidateCustomMachineType(t *testing.T) {
+	testCases := []struct {
+		machine     string
+		expectedErr string
+	}{
+		{machine: "e2-medium"},
+		{machine: "n1-standard-2"},
+		{machine: ""},
+		{machine: "custom-6-20480"},
+		{machine: "custom-1-1024"},
+		{machine: "n2-custom-8-32768"},
+		{machine: "e2-custom-4-8192"},
+		{machine: "n2-custom-2-32768-ext"},
+		{machine: "zones/us-central1-a/machineTypes/n2-custom-4-8192"},
+		{machine: "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a/machineTypes/custom-6-20480"},
+		{machine: "zones/us-central1-a/machineTypes/custom-3-4096", expectedErr: "vCPU count must be 1 or even"},
+		{machine: "custom-6-2048x", expectedErr: "expected custom-<cpu>-<memory-mb>"},
+		{machine: "custom-6", expectedErr: "expected custom-<cpu>-<memory-mb>"},
+		{machine: "foo9-custom-2-2048", expectedErr: "unsupported machine family"},
+		{machine: "custom-3-4096", expectedErr: "vCPU count must be 1 or even"},
+		{machine: "n2-custom-2-2000", expectedErr: "multiple of 256 MB"},
+		{machine: "n2-custom-8-2048", expectedErr: "at least 512 MB per vCPU"},
+		{machine: "n2-custom-2-32768", expectedErr: "requires the -ext suffix"},
+		{machine: "custom-2-1536", expectedErr: "at least 922 MB per vCPU"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.machine, func(t *testing.T) {
+			err := validateCustomMachineType(tc.machine)
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Errorf("expected %q to validate, got: %v", tc.machine, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Errorf("expected error containing %q for %q, got: %v", tc.expectedErr, tc.machine, err)
+			}
+		})
+	}
+}
+
+func TestCheckDaemonRunning(t *testing.T) {
+	oldSSH, oldTimeout := instanceUpSSH, *sshTimeout
+	defer func() { instanceUpSSH, *sshTimeout = oldSSH, oldTimeout }()
+	*sshTimeout = time.Second
+
+	g := &GCERunner{}
+
+	// SSH cannot reach the instance yet: retried and reported as such.
+	attempts := 0
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		attempts++
+		return "ssh: connect to host 1.2.3.4 port 22: Connection refused", errors.New("exit status 255")
+	}
+	err := g.checkDaemonRunning("test-instance")
+	if err == nil || !strings.Contains(err.Error(), "not reachable over SSH yet") {
+		t.Errorf("expected an SSH-not-up error, got: %v", err)
+	}
+	if attempts != daemonCheckSSHAttempts {
+		t.Errorf("expected %d SSH attempts for an unreachable instance, got %d", daemonCheckSSHAttempts, attempts)
+	}
+
+	// SSH works but the daemon isn't running: no retry, daemon error.
+	attempts = 0
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		attempts++
+		return "", errors.New("exit status 1")
+	}
+	err = g.checkDaemonRunning("test-instance")
+	if err == nil || !strings.Contains(err.Error(), "not running containerd/crio daemon") {
+		t.Errorf("expected a daemon-not-running error, got: %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected a single SSH attempt when the instance was reached, got %d", attempts)
+	}
+
+	// A hung SSH attempt is bounded by --ssh-timeout and counts as unreachable.
+	*sshTimeout = 10 * time.Millisecond
+	attempts = 0
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		attempts++
+		time.Sleep(200 * time.Millisecond)
+		return "", nil
+	}
+	err = g.checkDaemonRunning("test-instance")
+	if err == nil || !strings.Contains(err.Error(), "not reachable over SSH yet") {
+		t.Errorf("expected a timeout to be reported as SSH-not-up, got: %v", err)
+	}
+	if attempts != daemonCheckSSHAttempts {
+		t.Errorf("expected %d SSH attempts for hung connections, got %d", daemonCheckSSHAttempts, attempts)
+	}
+	*sshTimeout = time.Second
+
+	// Daemon running: success.
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		return "containerd.service running", nil
+	}
+	if err := g.checkDaemonRunning("test-instance"); err != nil {
+		t.Errorf("expected the daemon check to pass, got: %v", err)
+	}
+}
+
+func TestCheckDaemonRunningCustomService(t *testing.T) {
+	oldSSH, oldService := instanceUpSSH, *runtimeServiceName
+	defer func() { instanceUpSSH, *runtimeServiceName = oldSSH, oldService }()
+	*runtimeServiceName = "youki"
+
+	g := &GCERunner{}
+
+	// The readiness grep is built from the configured service name.
+	var sshCommand string
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		sshCommand = strings.Join(cmd, " ")
+		return "youki.service running", nil
+	}
+	if err := g.checkDaemonRunning("test-instance"); err != nil {
+		t.Errorf("expected the custom runtime service to pass the check, got: %v", err)
+	}
+	if !strings.Contains(sshCommand, "grep -e youki") {
+		t.Errorf("expected the readiness grep to match the configured service, got %q", sshCommand)
+	}
+
+	// A different running runtime does not satisfy the check, and the error
+	// names the expected service.
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		return "containerd.service running", nil
+	}
+	err := g.checkDaemonRunning("test-instance")
+	if err == nil || !strings.Contains(err.Error(), "not running youki daemon") {
+		t.Errorf("expected a daemon-not-running error naming youki, got: %v", err)
+	}
+
+	// Multiple names accept any of the listed services.
+	*runtimeServiceName = "kata, youki"
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		return "kata.service running", nil
+	}
+	if err := g.checkDaemonRunning("test-instance"); err != nil {
+		t.Errorf("expected any listed runtime service to pass the check, got: %v", err)
+	}
+}
+
+func TestSkipRuntimeCheckProceedsToRunRemote(t *testing.T) {
+	resultsDir := t.TempDir()
+	if err := flag.Lookup("results-dir").Value.Set(resultsDir); err != nil {
+		t.Fatalf("failed to set results-dir: %v", err)
+	}
+	oldZone, oldDelay, oldSSH, oldRunRemote := *zone, *initialReadinessDelay, instanceUpSSH, runRemote
+	oldSkip := *skipRuntimeCheck
+	defer func() {
+		*zone, *initialReadinessDelay, instanceUpSSH, runRemote = oldZone, oldDelay, oldSSH, oldRunRemote
+		*skipRuntimeCheck = oldSkip
+	}()
+	*zone = "us-west1-b"
+	*initialReadinessDelay = 0
+	*skipRuntimeCheck = true
+	// The image runs no systemd-managed runtime at boot: the readiness grep
+	// would fail, but plain SSH commands work.
+	instanceUpSSH = func(host string, cmd ...string) (string, error) {
+		if strings.Contains(strings.Join(cmd, " "), "grep") {
+			return "", errors.New("exit status 1")
+		}
+		return "", nil
+	}
+	runRemoteCalls := 0
+	runRemote = func(cfg remote.RunRemoteConfig) (string, bool, error) {
+		runRemoteCalls++
+		return "", true, nil
+	}
+
+	inserted := false
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			fmt.Fprint(w, `{"name": "delete-operation"}`)
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/instances"):
+			inserted = true
+			fmt.Fprint(w, `{"name": "insert-operation"}`)
+		case strings.Contains(r.URL.Path, "/operations/"):
+			fmt.Fprint(w, `{"status": "DONE"}`)
+		case strings.Contains(r.URL.Path, "/instances/"):
+			if !inserted {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `{"status": "RUNNING"}`)
+		case strings.Contains(r.URL.Path, "/projects/") && !strings.Contains(r.URL.Path, "/zones/"):
+			fmt.Fprint(w, `{"defaultServiceAccount": "default-sa@project.iam.gserviceaccount.com"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	g := &GCERunner{
+		cfg:               remote.Config{InstanceNamePrefix: "skip-check-test", DeleteInstances: true},
+		gceComputeService: cs,
+	}
+
+	result := g.runImageJob(nil, "", imageJob{
+		image:         &internalGCEImage{image: "cos-stable", project: "cos-cloud"},
+		junitFileName: "cos-stable",
+	})
+	if result == nil || result.Err != nil {
+		t.Fatalf("expected the image run to succeed without a runtime service, got %+v", result)
+	}
+	if runRemoteCalls != 1 {
+		t.Errorf("expected the run to proceed to RunRemote, got %d calls", runRemoteCalls)
+	}
+}
+
+func TestPrepareGceImagesMachinesExpansion(t *testing.T) {
+	oldProject, oldZone := *project, *zone
+	defer func() { *project, *zone = oldProject, oldZone }()
+	*project = "test-project"
+	*zone = "us-west1-b"
+
+	configFile := filepath.Join(t.TempDir(), "image-config.yaml")
+	if err := os.WriteFile(configFile, []byte(`images:
+  cos-bench:
+    image: cos-stable-109-17800-0-51
+    project: cos-cloud
+    machines: [n2-standard-4, n2-standard-8]
+  cos-plain:
+    image: cos-stable-109-17800-0-51
+    project: cos-cloud
+    machine: n1-standard-2
+`), 0644); err != nil {
+		t.Fatalf("failed to write image config: %v", err)
+	}
+	g := &GCERunner{cfg: remote.Config{ImageConfigFile: configFile}}
+	images, err := g.prepareGceImages()
+	if err != nil {
+		t.Fatalf("expected image preparation to succeed, got: %v", err)
+	}
+	if len(images.images) != 3 {
+		t.Fatalf("expected the machines list to expand into 3 internal images, got %d: %v", len(images.images), images.images)
+	}
+	for name, machine := range map[string]string{
+		"cos-bench-n2-standard-4": "n2-standard-4",
+		"cos-bench-n2-standard-8": "n2-standard-8",
+		"cos-plain":               "n1-standard-2",
+	} {
+		img, found := images.images[name]
+		if !found {
+			t.Errorf("expected an internal image named %q", name)
+			continue
+		}
+		if img.machine != machine {
+			t.Errorf("expected %q to use machine %q, got %q", name, machine, img.machine)
+		}
+	}
+
+	// machine and machines on the same entry is rejected up front.
+	err = validateImageConfig(&GCEImageConfig{Images: map[string]GCEImage{
+		"both": {Project: "cos-cloud", Machine: "n1-standard-2", Machines: []string{"n2-standard-4"}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "machine is mutually exclusive with machines") {
+		t.Errorf("expected a mutual-exclusion error for machine and machines, got: %v", err)
+	}
+}
+
+func TestMergeGinkgoFlags(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		base     string
+		tests    []string
+		skip     string
+		expected string
+	}{
+		{
+			desc:     "no per-image filters keeps the shared flags",
+			base:     "--no-color -v",
+			expected: "--no-color -v",
+		},
+		{
+			desc:     "single focus string",
+			base:     "--no-color -v",
+			tests:    []string{"\\[Feature:Benchmark\\]"},
+			expected: `--no-color -v --focus="\\[Feature:Benchmark\\]"`,
+		},
+		{
+			desc:     "multiple focus strings are or-ed",
+			base:     "--no-color",
+			tests:    []string{"density", "resource-usage"},
+			expected: `--no-color --focus="density|resource-usage"`,
+		},
+		{
+			desc:     "skip only",
+			base:     "--no-color",
+			skip:     "\\[Flaky\\]",
+			expected: `--no-color --skip="\\[Flaky\\]"`,
+		},
+		{
+			desc:     "focus and skip combined",
+			base:     "--no-color",
+			tests:    []string{"density"},
+			skip:     "\\[Serial\\]",
+			expected: `--no-color --focus="density" --skip="\\[Serial\\]"`,
+		},
+		{
+			desc:     "empty base has no leading space",
+			tests:    []string{"density"},
+			expected: `--focus="density"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := mergeGinkgoFlags(tc.base, tc.tests, tc.skip); got != tc.expected {
+				t.Errorf("mergeGinkgoFlags(%q, %v, %q) = %q, expected %q", tc.base, tc.tests, tc.skip, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestPrintResolvedImages(t *testing.T) {
+	oldProject, oldZone := *project, *zone
+	defer func() { *project, *zone = oldProject, oldZone }()
+	*project = "test-project"
+	*zone = "us-west1-b"
+
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/global/images") {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"items": [
+			{"name": "cos-stable-109-17800-0-51", "creationTimestamp": "2023-03-01T00:00:00Z"}
+		]}`)
+	})
+	configFile := filepath.Join(t.TempDir(), "image-config.yaml")
+	if err := os.WriteFile(configFile, []byte(`images:
+  cos-stable:
+    image_regex: cos-stable-.*
+    project: cos-cloud
+  cos-bench:
+    image_regex: cos-stable-.*
+    project: cos-cloud
+    machine: n1-standard-8
+`), 0644); err != nil {
+		t.Fatalf("failed to write image config: %v", err)
+	}
+	g := &GCERunner{cfg: remote.Config{ImageConfigFile: configFile}, gceComputeService: cs}
+	images, err := g.prepareGceImages()
+	if err != nil {
+		t.Fatalf("expected image preparation to succeed, got: %v", err)
+	}
+	g.gceImages = images
+
+	var buf bytes.Buffer
+	g.printResolvedImages(&buf)
+	out := buf.String()
+	// Both short names appear with their resolved concrete image.
+	for _, want := range []string{"cos-stable", "cos-bench", "cos-cloud/cos-stable-109-17800-0-51", "(n1-standard-8)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected the image table to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestGetGCEImageSkipsDeprecated(t *testing.T) {
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/global/images") {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"items": [
+			{"name": "cos-stable-109-3", "creationTimestamp": "2023-03-01T00:00:00Z", "deprecated": {"state": "DEPRECATED"}},
+			{"name": "cos-stable-109-2", "creationTimestamp": "2023-02-01T00:00:00Z"},
+			{"name": "cos-stable-109-1", "creationTimestamp": "2023-01-01T00:00:00Z", "deprecated": {"state": "OBSOLETE"}}
+		]}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	// The newest image is deprecated, so the newest active one must win.
+	image, err := g.getGCEImage("cos-stable-.*", "", "", "cos-cloud")
+	if err != nil {
+		t.Fatalf("expected image resolution to succeed, got: %v", err)
+	}
+	if image != "cos-stable-109-2" {
+		t.Errorf("expected the newest active image cos-stable-109-2, got %q", image)
+	}
+
+	oldAllow := *allowDeprecatedImages
+	defer func() { *allowDeprecatedImages = oldAllow }()
+	*allowDeprecatedImages = true
+	// Use a fresh runner, as resolution results are cached per runner.
+	g = &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+	image, err = g.getGCEImage("cos-stable-.*", "", "", "cos-cloud")
+	if err != nil {
+		t.Fatalf("expected image resolution to succeed, got: %v", err)
+	}
+	if image != "cos-stable-109-3" {
+		t.Errorf("expected the newest image when deprecated images are allowed, got %q", image)
+	}
+}
+
+func TestValidateAccelerators(t *testing.T) {
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/acceleratorTypes") {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"items": [
+			{"name": "nvidia-tesla-t4", "maximumCardsPerInstance": 4}
+		]}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+
+	for _, tc := range []struct {
+		name        string
+		accelerator Accelerator
+		wantErr     string
+	}{
+		{
+			name:        "available type within the card limit",
+			accelerator: Accelerator{Type: "nvidia-tesla-t4", Count: 2},
+		},
+		{
+			name:        "full type URL within the card limit",
+			accelerator: Accelerator{Type: "https://www.googleapis.com/compute/v1/projects/p/zones/us-west1-b/acceleratorTypes/nvidia-tesla-t4", Count: 2},
+		},
+		{
+			name:        "type not offered in the zone",
+			accelerator: Accelerator{Type: "nvidia-tesla-a100", Count: 1},
+			wantErr:     `accelerator type "nvidia-tesla-a100" is not available in zone "us-west1-b"`,
+		},
+		{
+			name:        "count above the per-instance maximum",
+			accelerator: Accelerator{Type: "nvidia-tesla-t4", Count: 8},
+			wantErr:     "at most 4 cards per instance",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			imageConfig := &internalGCEImage{
+				image:     "cos-stable",
+				zone:      "us-west1-b",
+				resources: Resources{Accelerators: []Accelerator{tc.accelerator}},
+			}
+			err := g.validateAccelerators(imageConfig)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected validation to pass, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestUpdateKernelArgumentsUnsupportedImage(t *testing.T) {
+	g := &GCERunner{}
+	err := g.updateKernelArguments(&compute.Instance{Name: "test-instance"}, "debian-12-bookworm", []string{"hugepages=512"})
+	if err == nil {
+		t.Fatal("expected an error for kernel arguments on an unsupported image")
+	}
+	if !strings.Contains(err.Error(), "not supported") || !strings.Contains(err.Error(), "hugepages=512") {
+		t.Errorf("expected the error to name the unsupported image and the arguments, got: %v", err)
+	}
+}
+
+func TestAddOSLoginMetadata(t *testing.T) {
+	metadata := addOSLoginMetadata(nil)
+	if len(metadata.Items) != 1 {
+		t.Fatalf("expected 1 metadata item, got %d", len(metadata.Items))
+	}
+	item := metadata.Items[0]
+	if item.Key != "enable-oslogin" || item.Value == nil || *item.Value != "TRUE" {
+		t.Errorf("expected enable-oslogin=TRUE, got %s=%v", item.Key, item.Value)
+	}
+
+	// Existing metadata must be preserved.
+	existing := "value"
+	metadata = addOSLoginMetadata(&compute.Metadata{Items: []*compute.MetadataItems{{Key: "existing", Value: &existing}}})
+	if len(metadata.Items) != 2 {
+		t.Errorf("expected existing metadata to be preserved, got %d items", len(metadata.Items))
+	}
+}
+
+func TestParseInstanceMetadata(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "user-data"), []byte("#cloud-config\n"), 0644); err != nil {
+		t.Fatalf("failed to write metadata file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "blob"), []byte{0x1f, 0x8b, 0x00}, 0644); err != nil {
+		t.Fatalf("failed to write metadata file: %v", err)
+	}
+	g := &GCERunner{cfg: remote.Config{ImageConfigDir: dir}}
+
+	metadata := g.parseInstanceMetadata("key=value,user-data<user-data,payload<<blob")
+	if got := metadata["key"]; got != "value" {
+		t.Errorf("key=value form: got %q, want value", got)
+	}
+	if got := metadata["user-data"]; got != "#cloud-config\n" {
+		t.Errorf("key<path form: got %q, want raw file contents", got)
+	}
+	if _, ok := metadata["payload"]; ok {
+		t.Error("key<<path form must not store the raw key")
+	}
+	if got := metadata["payload-b64"]; got != base64.StdEncoding.EncodeToString([]byte{0x1f, 0x8b, 0x00}) {
+		t.Errorf("key<<path form: got %q, want base64-encoded file contents", got)
+	}
+}
+
+func TestApplyOnHostMaintenance(t *testing.T) {
+	old := *onHostMaintenance
+	defer func() { *onHostMaintenance = old }()
+
+	// Without the flag the scheduling block is left alone.
+	*onHostMaintenance = ""
+	scheduling := compute.Scheduling{}
+	applyOnHostMaintenance(&scheduling)
+	if scheduling.OnHostMaintenance != "" {
+		t.Errorf("expected no policy without the flag, got %q", scheduling.OnHostMaintenance)
+	}
+
+	*onHostMaintenance = "TERMINATE"
+	applyOnHostMaintenance(&scheduling)
+	if scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("expected TERMINATE, got %q", scheduling.OnHostMaintenance)
+	}
+
+	// The GPU path forces TERMINATE; a requested MIGRATE must not undo it.
+	*onHostMaintenance = "MIGRATE"
+	scheduling = compute.Scheduling{OnHostMaintenance: "TERMINATE"}
+	applyOnHostMaintenance(&scheduling)
+	if scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("expected the forced TERMINATE to win over MIGRATE, got %q", scheduling.OnHostMaintenance)
+	}
+
+	scheduling = compute.Scheduling{}
+	applyOnHostMaintenance(&scheduling)
+	if scheduling.OnHostMaintenance != "MIGRATE" {
+		t.Errorf("expected MIGRATE, got %q", scheduling.OnHostMaintenance)
+	}
+}
+
+func TestApplyAutomaticRestart(t *testing.T) {
+	old := *automaticRestart
+	defer func() { *automaticRestart = old }()
+
+	for _, tc := range []struct {
+		name        string
+		flag        string
+		preemptible bool
+		want        *bool
+	}{
+		{name: "unset leaves the default", flag: "", want: nil},
+		{name: "explicit true", flag: "true", want: boolPtr(true)},
+		{name: "explicit false", flag: "false", want: boolPtr(false)},
+		{name: "true on preemptible is ignored", flag: "true", preemptible: true, want: nil},
+		{name: "false on preemptible is ignored", flag: "false", preemptible: true, want: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			*automaticRestart = tc.flag
+			scheduling := compute.Scheduling{Preemptible: tc.preemptible}
+			applyAutomaticRestart(&scheduling)
+			switch {
+			case tc.want == nil && scheduling.AutomaticRestart != nil:
+				t.Errorf("expected AutomaticRestart to stay unset, got %v", *scheduling.AutomaticRestart)
+			case tc.want != nil && (scheduling.AutomaticRestart == nil || *scheduling.AutomaticRestart != *tc.want):
+				t.Errorf("expected AutomaticRestart=%v, got %v", *tc.want, scheduling.AutomaticRestart)
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestInsertError(t *testing.T) {
+	apiErr := &googleapi.Error{Code: http.StatusBadRequest, Message: "invalid disk size 100%"}
+	err := insertError("test-instance", apiErr, nil)
+
+	// Literal '%' in API error text must survive unmangled.
+	if !strings.Contains(err.Error(), "invalid disk size 100%") {
+		t.Errorf("expected the API error text to be preserved, got: %v", err)
+	}
+	if strings.Contains(err.Error(), "%!") {
+		t.Errorf("expected no format-string corruption, got: %v", err)
+	}
+	// The underlying error must stay reachable for errors.As.
+	var unwrapped *googleapi.Error
+	if !errors.As(err, &unwrapped) || unwrapped.Code != http.StatusBadRequest {
+		t.Errorf("expected errors.As to find the googleapi error, got: %v", err)
+	}
+
+	// Operation errors and configuration hints are appended.
+	oldStack := *stackType
+	defer func() { *stackType = oldStack }()
+	*stackType = stackTypeDualStack
+	err = insertError("test-instance", apiErr, &compute.Operation{Error: &compute.OperationError{}})
+	if !strings.Contains(err.Error(), "dual-stack subnetwork") {
+		t.Errorf("expected the dual-stack hint, got: %v", err)
+	}
+}
+
+func TestQuotaErrorSurfaced(t *testing.T) {
+	quotaErr := &googleapi.Error{
+		Code:    http.StatusForbidden,
+		Message: "Quota 'CPUS' exceeded.  Limit: 24.0 in region europe-west1.",
+		Errors: []googleapi.ErrorItem{{
+			Reason:  "quotaExceeded",
+			Message: "Quota 'CPUS' exceeded.  Limit: 24.0 in region europe-west1.",
+		}},
+	}
+
+	// The insert error names the exhausted metric and region instead of
+	// burying them in the generic API error text.
+	err := insertError("test-instance", quotaErr, nil)
+	if err == nil || !strings.Contains(err.Error(), "exceeded CPUS quota in region europe-west1 (limit 24.0)") {
+		t.Errorf("expected the quota metric and region to be surfaced, got: %v", err)
+	}
+
+	// Quota errors are permanent, even when coded like a rate limit.
+	quotaErr.Code = http.StatusTooManyRequests
+	if isRetryableAPIError(quotaErr) {
+		t.Error("expected quota errors not to be retried")
+	}
+
+	// Global quotas have no region in the message.
+	globalErr := &googleapi.Error{
+		Code: http.StatusForbidden,
+		Errors: []googleapi.ErrorItem{{
+			Reason:  "quotaExceeded",
+			Message: "Quota 'GPUS_ALL_REGIONS' exceeded.  Limit: 1.0",
+		}},
+	}
+	if err := quotaError(globalErr); err == nil || !strings.Contains(err.Error(), "exceeded GPUS_ALL_REGIONS quota (limit 1.0)") {
+		t.Errorf("expected the global quota metric to be surfaced, got: %v", err)
+	}
+
+	// Non-quota errors pass through untouched.
+	if err := quotaError(&googleapi.Error{Code: http.StatusForbidden, Message: "permission denied"}); err != nil {
+		t.Errorf("expected no quota error for a permission failure, got: %v", err)
+	}
+}
+
+func TestValidateReturnsErrors(t *testing.T) {
+	oldProject, oldZone := *project, *zone
+	oldProvisionOnly, oldTestFromState := *provisionOnly, *testFromState
+	oldStateFile := *instanceStateFile
+	oldStackType := *stackType
+	defer func() {
+		*project, *zone = oldProject, oldZone
+		*provisionOnly, *testFromState = oldProvisionOnly, oldTestFromState
+		*instanceStateFile = oldStateFile
+		*stackType = oldStackType
+	}()
+	// Keep metadata-server defaulting out of the picture.
+	*project = "test-project"
+	*zone = "us-west1-b"
+
+	// No hosts, images or image config must be an error, not a process exit.
+	g := &GCERunner{cfg: remote.Config{}}
+	if err := g.Validate(); err == nil || !strings.Contains(err.Error(), "must specify one of") {
+		t.Errorf("expected a missing-input error, got: %v", err)
+	}
+
+	// Each early invalid-flag combination surfaces as an error too.
+	*provisionOnly = true
+	*testFromState = true
+	g = &GCERunner{cfg: remote.Config{Hosts: []string{"host"}}}
+	if err := g.Validate(); err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Errorf("expected a mutually-exclusive error, got: %v", err)
+	}
+
+	*testFromState = false
+	*instanceStateFile = ""
+	if err := g.Validate(); err == nil || !strings.Contains(err.Error(), "--instance-state-file") {
+		t.Errorf("expected a missing state-file error, got: %v", err)
+	}
+
+	*provisionOnly = false
+	*stackType = "IPV9"
+	if err := g.Validate(); err == nil || !strings.Contains(err.Error(), "--stack-type") {
+		t.Errorf("expected a stack-type error, got: %v", err)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	cs := fakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "delete-operation"}`)
+	})
+	g := &GCERunner{cfg: remote.Config{}, gceComputeService: cs}
+	g.recordHostZone("metrics-instance", "us-west1-b")
+
+	// Other tests share the global metrics, so count against a fresh set.
+	oldMetrics := gceMetrics
+	defer func() { gceMetrics = oldMetrics }()
+	gceMetrics = newRunnerMetrics()
+
+	// Drive a couple of instrumented paths for real.
+	g.deleteGCEInstance("metrics-instance")
+	calls := 0
+	_ = withAPIRetries(func() error {
+		calls++
+		if calls == 1 {
+			return &googleapi.Error{Code: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+
+	server := httptest.NewServer(promhttp.HandlerFor(gceMetrics.registry, promhttp.HandlerOpts{}))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to fetch metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics response: %v", err)
+	}
+	for _, series := range []string{
+		"node_e2e_instances_deleted_total 1",
+		"node_e2e_api_retries_total 1",
+	} {
+		if !strings.Contains(string(body), series) {
+			t.Errorf("expected metrics output to contain %q, got:\n%s", series, body)
+		}
+	}
+}
+
+func TestValidateImageConfig(t *testing.T) {
+	config := &GCEImageConfig{Images: map[string]GCEImage{
+		"good": {
+			Image:   "cos-stable-109",
+			Project: "cos-cloud",
+		},
+		"no-project": {
+			Image: "cos-stable-109",
+		},
+		"ambiguous": {
+			Image:      "cos-stable-109",
+			ImageRegex: "cos-stable-.*",
+			Project:    "cos-cloud",
+		},
+		"bad-arch": {
+			Image:        "cos-stable-109",
+			Project:      "cos-cloud",
+			Architecture: "sparc",
+		},
+		"bad-ssd": {
+			Image:         "cos-stable-109",
+			Project:       "cos-cloud",
+			LocalSSDCount: -1,
+		},
+		"bad-accelerator": {
+			Image:     "cos-stable-109",
+			Project:   "cos-cloud",
+			Resources: Resources{Accelerators: []Accelerator{{Type: "nvidia-tesla-t4", Count: 0}}},
+		},
+	}}
+
+	err := validateImageConfig(config)
+	if err == nil {
+		t.Fatal("expected validation errors, got nil")
+	}
+	// All problems must be reported at once, each naming its short name.
+	for _, want := range []string{"no-project:", "ambiguous:", "bad-arch:", "bad-ssd:", "bad-accelerator:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q, got: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "good:") {
+		t.Errorf("expected no error for the valid image, got: %v", err)
+	}
+
+	// A fully valid config validates cleanly.
+	if err := validateImageConfig(&GCEImageConfig{Images: map[string]GCEImage{
+		"good": {ImageRegex: "cos-stable-.*", Project: "cos-cloud", Architecture: "X86_64"},
+	}}); err != nil {
+		t.Errorf("expected a valid config to pass, got: %v", err)
+	}
+}
+
+func TestReadImageConfig(t *testing.T) {
+	t.Run("local file with config dir", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "images.yaml"), []byte("local config"), 0644); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+		g := &GCERunner{cfg: remote.Config{ImageConfigFile: "images.yaml", ImageConfigDir: dir}}
+		data, err := g.readImageConfig()
+		if err != nil {
+			t.Fatalf("expected local read to succeed, got: %v", err)
+		}
+		if string(data) != "local config" {
+			t.Errorf("unexpected config contents: %q", data)
+		}
+	})
+
+	t.Run("http url", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "http config")
+		}))
+		defer server.Close()
+		// ImageConfigDir must not be joined onto URLs.
+		g := &GCERunner{cfg: remote.Config{ImageConfigFile: server.URL + "/images.yaml", ImageConfigDir: "/nonexistent"}}
+		data, err := g.readImageConfig()
+		if err != nil {
+			t.Fatalf("expected http fetch to succeed, got: %v", err)
+		}
+		if string(data) != "http config" {
+			t.Errorf("unexpected config contents: %q", data)
+		}
+	})
+
+	t.Run("gcs path", func(t *testing.T) {
+		oldFetch := fetchGCSObject
+		defer func() { fetchGCSObject = oldFetch }()
+		fetchGCSObject = func(g *GCERunner, bucket, object string) ([]byte, error) {
+			if bucket != "config-bucket" || object != "node/images.yaml" {
+				t.Errorf("unexpected GCS location %s/%s", bucket, object)
+			}
+			return []byte("gcs config"), nil
+		}
+		g := &GCERunner{cfg: remote.Config{ImageConfigFile: "gs://config-bucket/node/images.yaml"}}
+		data, err := g.readImageConfig()
+		if err != nil {
+			t.Fatalf("expected GCS fetch to succeed, got: %v", err)
+		}
+		if string(data) != "gcs config" {
+			t.Errorf("unexpected config contents: %q", data)
+		}
+	})
+
+	t.Run("malformed gcs path", func(t *testing.T) {
+		g := &GCERunner{cfg: remote.Config{ImageConfigFile: "gs://bucket-only"}}
+		if _, err := g.readImageConfig(); err == nil {
+			t.Error("expected an error for a gs:// path without an object")
+		}
+	})
+}
+
+func TestDefaultProjectAndZoneFromMetadata(t *testing.T) {
+	oldProject := *project
+	oldZone := *zone
+	oldURL := metadataServerURL
+	defer func() {
+		*project = oldProject
+		*zone = oldZone
+		metadataServerURL = oldURL
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing Metadata-Flavor header", http.StatusForbidden)
+			return
+		}
+		switch {
+		case strings.HasSuffix(r.URL.Path, "project/project-id"):
+			fmt.Fprint(w, "detected-project")
+		case strings.HasSuffix(r.URL.Path, "instance/zone"):
+			fmt.Fprint(w, "projects/12345/zones/us-west1-b")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	metadataServerURL = server.URL
+
+	*project = ""
+	*zone = ""
+	defaultProjectAndZoneFromMetadata()
+	if *project != "detected-project" {
+		t.Errorf("expected --project to default to detected-project, got %q", *project)
+	}
+	if *zone != "us-west1-b" {
+		t.Errorf("expected --zone to default to us-west1-b, got %q", *zone)
+	}
+
+	// Explicit flags are never overwritten.
+	*project = "explicit-project"
+	*zone = "explicit-zone"
+	defaultProjectAndZoneFromMetadata()
+	if *project != "explicit-project" || *zone != "explicit-zone" {
+		t.Errorf("expected explicit flags to be kept, got project=%q zone=%q", *project, *zone)
+	}
+
+	// An unreachable metadata server leaves the flags empty.
+	server.Close()
+	*project = ""
+	*zone = ""
+	defaultProjectAndZoneFromMetadata()
+	if *project != "" || *zone != "" {
+		t.Errorf("expected flags to stay empty when the metadata server is unreachable, got project=%q zone=%q", *project, *zone)
+	}
+}
+
+func TestImageToInstanceNameSuffix(t *testing.T) {
+	old := *instanceNameSuffix
+	defer func() { *instanceNameSuffix = old }()
+	g := &GCERunner{cfg: remote.Config{InstanceNamePrefix: "test"}}
+	img := &internalGCEImage{image: "cos-stable"}
+
+	*instanceNameSuffix = ""
+	if got := g.imageToInstanceName(img); got != "test-cos-stable" {
+		t.Errorf("imageToInstanceName() = %q, want test-cos-stable", got)
+	}
+
+	*instanceNameSuffix = "shard1"
+	if got := g.imageToInstanceName(img); got != "test-cos-stable-shard1" {
+		t.Errorf("imageToInstanceName() = %q, want test-cos-stable-shard1", got)
+	}
+
+	// The benchmark path keeps its uuid and still gets the suffix.
+	bench := &internalGCEImage{image: "cos-stable", machine: "n1-standard-2"}
+	name := g.imageToInstanceName(bench)
+	if !strings.HasPrefix(name, "n1-standard-2-cos-stable-") || !strings.HasSuffix(name, "-shard1") {
+		t.Errorf("expected machine-image-uuid-suffix form, got %q", name)
+	}
+
+	// Long names stay within the limit while remaining unique per suffix.
+	long := &internalGCEImage{image: strings.Repeat("x", 80)}
+	name = g.imageToInstanceName(long)
+	if len(name) > maxInstanceNameLength {
+		t.Errorf("expected name within %d chars, got %d: %q", maxInstanceNameLength, len(name), name)
+	}
+	*instanceNameSuffix = "shard2"
+	if other := g.imageToInstanceName(long); other == name {
+		t.Errorf("expected distinct suffixes to produce distinct names, both got %q", name)
+	}
+}
+
+func TestSafeInstanceName(t *testing.T) {
+	// Short names pass through, lowercased.
+	if got := safeInstanceName("Test-COS-Stable"); got != "test-cos-stable" {
+		t.Errorf("safeInstanceName() = %q, want test-cos-stable", got)
+	}
+
+	longA := "n1-standard-2-ubuntu-2204-jammy-v20240101-" + strings.Repeat("a", 40)
+	longB := "n1-standard-2-ubuntu-2204-jammy-v20240101-" + strings.Repeat("b", 40)
+	nameA := safeInstanceName(longA)
+	nameB := safeInstanceName(longB)
+	if len(nameA) > maxInstanceNameLength || len(nameB) > maxInstanceNameLength {
+		t.Errorf("expected names within %d chars, got %d and %d", maxInstanceNameLength, len(nameA), len(nameB))
+	}
+	if nameA == nameB {
+		t.Errorf("expected distinct long names to stay unique, both got %q", nameA)
+	}
+	if strings.HasSuffix(nameA, "-") {
+		t.Errorf("expected no trailing hyphen, got %q", nameA)
+	}
+	// Truncation is deterministic.
+	if again := safeInstanceName(longA); again != nameA {
+		t.Errorf("expected deterministic truncation, got %q then %q", nameA, again)
+	}
+}
+
+func TestApplyBuildID(t *testing.T) {
+	old := *buildID
+	defer func() { *buildID = old }()
+	t.Setenv("PROW_JOB_ID", "")
+	t.Setenv("BUILD_ID", "")
+
+	// Without an id the instance is left untouched.
+	*buildID = ""
+	i := &compute.Instance{}
+	applyBuildID(i)
+	if i.Labels != nil || i.Metadata != nil {
+		t.Errorf("expected no tagging without a build id, got labels=%v metadata=%v", i.Labels, i.Metadata)
+	}
+
+	*buildID = "build-42"
+	applyBuildID(i)
+	if got := i.Labels[buildIDKey]; got != "build-42" {
+		t.Errorf("expected label %s=build-42, got %q", buildIDKey, got)
+	}
+	if len(i.Metadata.Items) != 1 {
+		t.Fatalf("expected 1 metadata item, got %d", len(i.Metadata.Items))
+	}
+	item := i.Metadata.Items[0]
+	if item.Key != buildIDKey || item.Value == nil || *item.Value != "build-42" {
+		t.Errorf("expected metadata %s=build-42, got %s=%v", buildIDKey, item.Key, item.Value)
+	}
+
+	// The flag takes precedence over the environment.
+	t.Setenv("PROW_JOB_ID", "from-prow")
+	if got := resolveBuildID(); got != "build-42" {
+		t.Errorf("expected the flag to win over PROW_JOB_ID, got %q", got)
+	}
+	*buildID = ""
+	if got := resolveBuildID(); got != "from-prow" {
+		t.Errorf("expected PROW_JOB_ID to be used, got %q", got)
+	}
+	t.Setenv("PROW_JOB_ID", "")
+	t.Setenv("BUILD_ID", "from-build")
+	if got := resolveBuildID(); got != "from-build" {
+		t.Errorf("expected BUILD_ID to be used, got %q", got)
+	}
+}
+
+func TestKeepForDebugging(t *testing.T) {
+	old := *keepOnFailure
+	defer func() { *keepOnFailure = old }()
+
+	// Without the flag, failures delete as usual.
+	*keepOnFailure = false
+	if keepForDebugging(false) {
+		t.Error("expected failures to delete without --keep-on-failure")
+	}
+
+	*keepOnFailure = true
+	if !keepForDebugging(false) {
+		t.Error("expected a failed run to keep its instance with --keep-on-failure")
+	}
+	if keepForDebugging(true) {
+		t.Error("expected a passing run to delete its instance")
+	}
+}
+
+func TestSerialChunk(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cursor   int64
+		out      *compute.SerialPortOutput
+		want     string
+		wantNext int64
+	}{{
+		name:     "first poll returns everything",
+		cursor:   0,
+		out:      &compute.SerialPortOutput{Contents: "booting\n", Start: 0, Next: 8},
+		want:     "booting\n",
+		wantNext: 8,
+	}, {
+		name:     "overlap with an earlier start is trimmed",
+		cursor:   8,
+		out:      &compute.SerialPortOutput{Contents: "booting\nmounted\n", Start: 0, Next: 16},
+		want:     "mounted\n",
+		wantNext: 16,
+	}, {
+		name:     "no new output",
+		cursor:   16,
+		out:      &compute.SerialPortOutput{Contents: "", Start: 16, Next: 16},
+		want:     "",
+		wantNext: 16,
+	}, {
+		name:     "missing next falls back to start plus length",
+		cursor:   0,
+		out:      &compute.SerialPortOutput{Contents: "abc", Start: 4},
+		want:     "abc",
+		wantNext: 7,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			chunk, next := serialChunk(tc.cursor, tc.out)
+			if chunk != tc.want {
+				t.Errorf("serialChunk() chunk = %q, want %q", chunk, tc.want)
+			}
+			if next != tc.wantNext {
+				t.Errorf("serialChunk() next = %d, want %d", next, tc.wantNext)
+			}
+		})
+	}
+}
+
+func TestCollectJournalLog(t *testing.T) {
+	resultsDir := t.TempDir()
+	if err := flag.Lookup("results-dir").Value.Set(resultsDir); err != nil {
+		t.Fatalf("failed to set results-dir: %v", err)
+	}
+	oldSSH := journalSSH
+	oldCopy := copyFileFromHost
+	defer func() {
+		journalSSH = oldSSH
+		copyFileFromHost = oldCopy
+	}()
+
+	var dumped bool
+	journalSSH = func(host string, cmd ...string) (string, error) {
+		dumped = true
+		if !strings.Contains(strings.Join(cmd, " "), "journalctl --no-pager -o short-precise") {
+			t.Errorf("expected a journalctl dump command, got %v", cmd)
+		}
+		return "", nil
+	}
+	copyFileFromHost = func(host, remotePath, localPath string) (string, error) {
+		return "", os.WriteFile(localPath, []byte("journal contents\n"), 0644)
+	}
+
+	g := &GCERunner{}
+	if err := g.collectJournalLog("journal-host"); err != nil {
+		t.Fatalf("expected journal collection to succeed, got: %v", err)
+	}
+	if !dumped {
+		t.Error("expected journalctl to be run on the host")
+	}
+	data, err := os.ReadFile(filepath.Join(resultsDir, "journal-host", "journal.log"))
+	if err != nil {
+		t.Fatalf("failed to read journal artifact: %v", err)
+	}
+	if string(data) != "journal contents\n" {
+		t.Errorf("unexpected journal artifact contents: %q", data)
+	}
+
+	// A dead node must surface as an error, not a panic.
+	journalSSH = func(host string, cmd ...string) (string, error) {
+		return "", errors.New("connection refused")
+	}
+	if err := g.collectJournalLog("journal-host"); err == nil {
+		t.Error("expected an error when the node is unreachable")
+	}
+}
+
+func TestRunPreflightScript(t *testing.T) {
+	oldScript := *preflightScript
+	oldCopy := copyFileToHost
+	oldSSH := preflightSSH
+	defer func() {
+		*preflightScript = oldScript
+		copyFileToHost = oldCopy
+		preflightSSH = oldSSH
+	}()
+	*preflightScript = "/local/preflight.sh"
+
+	var copied, ran bool
+	copyFileToHost = func(host, localPath, remotePath string) (string, error) {
+		copied = true
+		if localPath != "/local/preflight.sh" {
+			t.Errorf("expected the --preflight-script path to be copied, got %q", localPath)
+		}
+		return "", nil
+	}
+	preflightSSH = func(host string, cmd ...string) (string, error) {
+		ran = true
+		return "all good", nil
+	}
+
+	g := &GCERunner{}
+	if err := g.runPreflightScript("preflight-host"); err != nil {
+		t.Fatalf("expected a passing preflight script to succeed, got: %v", err)
+	}
+	if !copied || !ran {
+		t.Errorf("expected the script to be copied and run, got copied=%v ran=%v", copied, ran)
+	}
+
+	// A non-zero exit fails the image with the script's output.
+	preflightSSH = func(host string, cmd ...string) (string, error) {
+		return "swap is still enabled", errors.New("exit status 1")
+	}
+	err := g.runPreflightScript("preflight-host")
+	if err == nil || !strings.Contains(err.Error(), "swap is still enabled") {
+		t.Errorf("expected a failure naming the script output, got: %v", err)
+	}
+
+	// Without the flag the preflight step is a no-op.
+	*preflightScript = ""
+	copied = false
+	if err := g.runPreflightScript("preflight-host"); err != nil || copied {
+		t.Errorf("expected a no-op without --preflight-script, got err=%v copied=%v", err, copied)
+	}
+}
+
+func TestMergeInstanceMetadataDuplicates(t *testing.T) {
+	g := &GCERunner{}
+
+	// Duplicate keys within a single metadata string.
+	metadata, duplicates := g.mergeInstanceMetadata("user-data=a,key=b,user-data=c")
+	if !reflect.DeepEqual(duplicates, []string{"user-data"}) {
+		t.Errorf("expected [user-data] as duplicate keys, got %v", duplicates)
+	}
+	if got := metadata["user-data"]; got != "c" {
+		t.Errorf("expected the later value to win, got %q", got)
+	}
+
+	// Collisions between the metadata string and --node-env.
+	nodeEnvs["key"] = "from-node-env"
+	defer delete(nodeEnvs, "key")
+	_, duplicates = g.mergeInstanceMetadata("key=b")
+	if !reflect.DeepEqual(duplicates, []string{"key"}) {
+		t.Errorf("expected [key] as duplicate keys, got %v", duplicates)
+	}
+
+	// No duplicates for distinct keys.
+	delete(nodeEnvs, "key")
+	if _, duplicates := g.mergeInstanceMetadata("a=1,b=2"); len(duplicates) != 0 {
+		t.Errorf("expected no duplicates, got %v", duplicates)
+	}
+}
+
+func TestAddSSHKeysMetadata(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "id_rsa.pub")
+	if err := os.WriteFile(keyFile, []byte("ssh-rsa AAAAB3Nza test@example.com\n"), 0644); err != nil {
+		t.Fatalf("failed to write public key file: %v", err)
+	}
+	t.Setenv("GCE_SSH_PUBLIC_KEY_FILE", keyFile)
+	t.Setenv("IGNITION_INJECT_GCE_SSH_PUBLIC_KEY_FILE", "")
+	sshUserFlag := flag.Lookup("ssh-user")
+	oldUser := sshUserFlag.Value.String()
+	defer sshUserFlag.Value.Set(oldUser)
+	sshUserFlag.Value.Set("ubuntu")
+
+	metadata := addSSHKeysMetadata(nil)
+	if len(metadata.Items) != 1 {
+		t.Fatalf("expected 1 metadata item, got %d", len(metadata.Items))
+	}
+	item := metadata.Items[0]
+	want := "ubuntu:ssh-rsa AAAAB3Nza test@example.com"
+	if item.Key != "ssh-keys" || item.Value == nil || *item.Value != want {
+		t.Errorf("expected ssh-keys=%q, got %s=%v", want, item.Key, item.Value)
+	}
+
+	// Re-adding the same key must not duplicate the entry.
+	metadata = addSSHKeysMetadata(metadata)
+	if len(metadata.Items) != 1 || *metadata.Items[0].Value != want {
+		t.Errorf("expected the key to be added once, got %d items with value %q", len(metadata.Items), *metadata.Items[0].Value)
+	}
+
+	// A pre-existing ssh-keys item gets the key appended.
+	existing := "core:ssh-rsa other"
+	metadata = addSSHKeysMetadata(&compute.Metadata{Items: []*compute.MetadataItems{{Key: "ssh-keys", Value: &existing}}})
+	if got := *metadata.Items[0].Value; got != "core:ssh-rsa other\n"+want {
+		t.Errorf("expected the key to be appended to the existing item, got %q", got)
+	}
+
+	// Ignition images handle key injection themselves.
+	t.Setenv("IGNITION_INJECT_GCE_SSH_PUBLIC_KEY_FILE", keyFile)
+	if metadata := addSSHKeysMetadata(nil); metadata != nil {
+		t.Errorf("expected no metadata for ignition images, got %+v", metadata)
+	}
+}
+
+func TestOSLoginUsername(t *testing.T) {
+	if got := osLoginUsername("Jamie.Doe@example.com"); got != "jamie_doe_example_com" {
+		t.Errorf("osLoginUsername() = %q, want jamie_doe_example_com", got)
+	}
+	if got := osLoginUsername(""); got != "" {
+		t.Errorf("expected an empty username for an empty email, got %q", got)
+	}
+}
+
+func TestBootIDChanged(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		before, after string
+		want          bool
+	}{
+		{name: "changed", before: "aaaa-bbbb\n", after: "cccc-dddd\n", want: true},
+		{name: "unchanged", before: "aaaa-bbbb\n", after: "aaaa-bbbb", want: false},
+		{name: "empty after", before: "aaaa-bbbb", after: "", want: false},
+		{name: "empty before", before: "", after: "cccc-dddd", want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := bootIDChanged(tc.before, tc.after); got != tc.want {
+				t.Errorf("bootIDChanged(%q, %q) = %v, want %v", tc.before, tc.after, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRebootInstanceFastReboot(t *testing.T) {
+	oldSSH := rebootSSH
+	defer func() { rebootSSH = oldSSH }()
+
+	rebooted := false
+	rebootSSH = func(host string, cmd ...string) (string, error) {
+		if cmd[0] == "reboot" {
+			rebooted = true
+			return "", errors.New("connection closed by remote host")
+		}
+		// The node is already back with a new boot id by the first poll, with
+		// no observable SSH-down window.
+		if rebooted {
+			return "cccc-dddd\n", nil
+		}
+		return "aaaa-bbbb\n", nil
+	}
+
+	g := &GCERunner{}
+	if err := g.rebootInstance(&compute.Instance{Name: "test-instance"}); err != nil {
+		t.Errorf("expected the fast reboot to be detected via the boot id, got: %v", err)
+	}
+	if !rebooted {
+		t.Error("expected the reboot command to be issued")
+	}
+}
+
+func TestVerifyKernelArguments(t *testing.T) {
+	oldSSH := kernelArgsSSH
+	defer func() { kernelArgsSSH = oldSSH }()
+	kernelArgsSSH = func(host string, cmd ...string) (string, error) {
+		return "BOOT_IMAGE=/syslinux/vmlinuz.A cros_efi hugepages=512\n", nil
+	}
+
+	if err := verifyKernelArguments("test-instance", []string{"hugepages=512"}); err != nil {
+		t.Errorf("expected present arguments to verify, got: %v", err)
+	}
+
+	err := verifyKernelArguments("test-instance", []string{"hugepages=512", "isolcpus=1-3"})
+	if err == nil {
+		t.Fatal("expected an error for a missing kernel argument")
+	}
+	if !strings.Contains(err.Error(), "isolcpus=1-3") || strings.Contains(err.Error(), "[hugepages=512") {
+		t.Errorf("expected only the missing argument to be listed, got: %v", err)
+	}
+}
+
+func TestFlatcarKernelArgumentsCommands(t *testing.T) {
+	cmds := flatcarKernelArgumentsCommands("hugepages=512")
+	joined := strings.Join(cmds, "&&")
+	if !strings.Contains(joined, "/dev/disk/by-label/OEM") {
+		t.Errorf("expected the OEM partition to be mounted, got: %s", joined)
+	}
+	if !strings.Contains(joined, `linux_append=\"$linux_append hugepages=512\"`) && !strings.Contains(joined, `linux_append="$linux_append hugepages=512"`) {
+		t.Errorf("expected the arguments to be appended to linux_append, got: %s", joined)
+	}
+}
+
+func TestCosKernelArgumentsCommands(t *testing.T) {
+	// The grub config moved within the EFI partition in COS milestone 101, so
+	// the sed target depends on the milestone encoded in the image name.
+	for _, tc := range []struct {
+		name        string
+		image       string
+		wantGrubCfg string
+	}{
+		{
+			name:        "current milestone uses efi/boot",
+			image:       "cos-stable-109-17800-0-51",
+			wantGrubCfg: "${dir}/efi/boot/grub.cfg",
+		},
+		{
+			name:        "pre-101 milestone uses the partition root",
+			image:       "cos-89-16108-403-47",
+			wantGrubCfg: "${dir}/boot/grub.cfg",
+		},
+		{
+			name:        "unknown milestone falls back to the current layout",
+			image:       "cos-custom-build",
+			wantGrubCfg: "${dir}/efi/boot/grub.cfg",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := strings.Join(cosKernelArgumentsCommands(tc.image, "quiet"), "&&")
+			if !strings.Contains(cmd, tc.wantGrubCfg) {
+				t.Errorf("expected the commands to target %q, got %q", tc.wantGrubCfg, cmd)
+			}
+			if !strings.Contains(cmd, "mount /dev/sda12") {
+				t.Errorf("expected the commands to mount the EFI partition, got %q", cmd)
+			}
+		})
+	}
+}
+
+func TestParseCOSMilestone(t *testing.T) {
+	for image, want := range map[string]int{
+		"cos-stable-109-17800-0-51": 109,
+		"cos-arm64-105-17412-1-75":  105,
+		"cos-89-16108-403-47":       89,
+	} {
+		milestone, err := parseCOSMilestone(image)
+		if err != nil {
+			t.Errorf("parseCOSMilestone(%q) failed: %v", image, err)
+			continue
+		}
+		if milestone != want {
+			t.Errorf("parseCOSMilestone(%q) = %d, want %d", image, milestone, want)
+		}
+	}
+	if _, err := parseCOSMilestone("ubuntu-2204-lts"); err == nil {
+		t.Error("expected a non-COS image name to be rejected")
+	}
+}
+
+func TestAcceleratorType(t *testing.T) {
+	oldProject := *project
+	defer func() { *project = oldProject }()
+	*project = "test-project"
+
+	g := &GCERunner{cfg: remote.Config{}}
+	imageConfig := &internalGCEImage{image: "cos-stable", project: "cos-cloud", zone: "us-west1-b"}
+
+	want := "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-west1-b/acceleratorTypes/nvidia-tesla-t4"
+	if got := g.acceleratorType(imageConfig, "nvidia-tesla-t4"); got != want {
+		t.Errorf("acceleratorType() = %q, want %q", got, want)
+	}
+
+	// A launch_project override moves the accelerator type into that project.
+	imageConfig.launchProject = "other-project"
+	want = "https://www.googleapis.com/compute/v1/projects/other-project/zones/us-west1-b/acceleratorTypes/nvidia-tesla-t4"
+	if got := g.acceleratorType(imageConfig, "nvidia-tesla-t4"); got != want {
+		t.Errorf("acceleratorType() = %q, want %q", got, want)
+	}
+	imageConfig.launchProject = ""
+
+	// A full accelerator-type URL from the config must be used verbatim.
+	url := "https://www.googleapis.com/compute/v1/projects/other-project/zones/us-central1-a/acceleratorTypes/nvidia-tesla-v100"
+	if got := g.acceleratorType(imageConfig, url); got != url {
+		t.Errorf("acceleratorType() = %q, want the URL passed through verbatim", got)
+	}
+}
+
+func TestMachineType(t *testing.T) {
+	g := &GCERunner{cfg: remote.Config{}}
+
+	for _, tc := range []struct {
+		name    string
+		machine string
+		want    string
+	}{
+		{
+			name:    "bare name is wrapped",
+			machine: "n2-standard-4",
+			want:    "zones/us-west1-b/machineTypes/n2-standard-4",
+		},
+		{
+			name:    "machine-type path is used verbatim",
+			machine: "zones/us-central1-a/machineTypes/n2-standard-8",
+			want:    "zones/us-central1-a/machineTypes/n2-standard-8",
+		},
+		{
+			name:    "full URL is used verbatim",
+			machine: "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-a/machineTypes/n2-standard-8",
+			want:    "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-a/machineTypes/n2-standard-8",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := g.machineType("us-west1-b", tc.machine); got != tc.want {
+				t.Errorf("machineType(%q) = %q, want %q", tc.machine, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInstanceDisksBootDiskDeviceName(t *testing.T) {
+	g := &GCERunner{cfg: remote.Config{}}
+	imageConfig := &internalGCEImage{
+		image:   "cos-stable",
+		project: "cos-cloud",
+	}
+
+	disks := g.instanceDisks(imageConfig)
+	if disks[0].DeviceName != "" {
+		t.Errorf("expected empty device name by default, got %q", disks[0].DeviceName)
+	}
+
+	oldDeviceName := *bootDiskDeviceName
+	defer func() { *bootDiskDeviceName = oldDeviceName }()
+	*bootDiskDeviceName = "test-boot-disk"
+
+	disks = g.instanceDisks(imageConfig)
+	if disks[0].DeviceName != "test-boot-disk" {
+		t.Errorf("expected boot disk device name %q, got %q", "test-boot-disk", disks[0].DeviceName)
+	}
+}
+
+func TestInstanceDisksLocalSSD(t *testing.T) {
+	g := &GCERunner{cfg: remote.Config{}}
+	for _, tc := range []struct {
+		name          string
+		localSSDCount int64
+		wantDisks     int
+	}{
+		{
+			name:          "no local SSDs",
+			localSSDCount: 0,
+			wantDisks:     1,
+		},
+		{
+			name:          "two local SSDs",
+			localSSDCount: 2,
+			wantDisks:     3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			imageConfig := &internalGCEImage{
+				image:         "cos-stable",
+				project:       "cos-cloud",
+				localSSDCount: tc.localSSDCount,
+			}
+			disks := g.instanceDisks(imageConfig)
+			if len(disks) != tc.wantDisks {
+				t.Fatalf("expected %d disks, got %d", tc.wantDisks, len(disks))
+			}
+			boot := disks[0]
+			if !boot.Boot || boot.Type != "PERSISTENT" {
+				t.Errorf("expected first disk to be a persistent boot disk, got %+v", boot)
+			}
+			if boot.InitializeParams.DiskSizeGb != 20 {
+				t.Errorf("expected boot disk size 20GB, got %d", boot.InitializeParams.DiskSizeGb)
+			}
+			for _, disk := range disks[1:] {
+				if disk.Type != "SCRATCH" {
+					t.Errorf("expected local SSD type SCRATCH, got %q", disk.Type)
+				}
+				if disk.Interface != "NVME" {
+					t.Errorf("expected local SSD interface NVME, got %q", disk.Interface)
+				}
+				if disk.InitializeParams.DiskSizeGb != localSSDSizeGb {
+					t.Errorf("expected local SSD size %dGB, got %d", localSSDSizeGb, disk.InitializeParams.DiskSizeGb)
+				}
+			}
+		})
+	}
+}
+
+func TestInstanceDisksGuestOsFeatures(t *testing.T) {
+	g := &GCERunner{cfg: remote.Config{}}
+	imageConfig := &internalGCEImage{
+		image:           "custom-shielded",
+		project:         "test-project",
+		guestOsFeatures: []string{"UEFI_COMPATIBLE", "sev_capable"},
+	}
+
+	disks := g.instanceDisks(imageConfig)
+	var got []string
+	for _, feature := range disks[0].GuestOsFeatures {
+		got = append(got, feature.Type)
+	}
+	if !reflect.DeepEqual(got, []string{"UEFI_COMPATIBLE", "SEV_CAPABLE"}) {
+		t.Errorf("expected the guest OS features on the boot disk, got %v", got)
+	}
+
+	// Without features configured the field stays unset.
+	disks = g.instanceDisks(&internalGCEImage{image: "cos-stable", project: "cos-cloud"})
+	if len(disks[0].GuestOsFeatures) != 0 {
+		t.Errorf("expected no guest OS features by default, got %+v", disks[0].GuestOsFeatures)
+	}
+
+	// Unknown feature types are rejected during config validation.
+	err := validateImageConfig(&GCEImageConfig{Images: map[string]GCEImage{
+		"bad-feature": {
+			Image:           "custom-shielded",
+			Project:         "test-project",
+			GuestOsFeatures: []string{"UEFI_COMPATIBLE", "HOLOGRAPHIC_DISPLAY"},
+		},
+	}})
+	if err == nil || !strings.Contains(err.Error(), `bad-feature: unknown guest OS feature "HOLOGRAPHIC_DISPLAY"`) {
+		t.Errorf("expected an unknown-feature error, got: %v", err)
+	}
+}
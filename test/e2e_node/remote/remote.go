@@ -262,6 +262,11 @@ func collectSystemLog(host string) {
 	}
 }
 
+// ResultsDir returns the local directory test results are collected into.
+func ResultsDir() string {
+	return *resultsDir
+}
+
 // WriteLog is a temporary function to make it possible to write log
 // in the runner. This is used to collect serial console log.
 // TODO(random-liu): Use the log-dump script in cluster e2e.
@@ -17,6 +17,7 @@ limitations under the License.
 package remote
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -43,6 +44,7 @@ var deleteInstances = flag.Bool("delete-instances", true, "If true, delete any i
 var buildOnly = flag.Bool("build-only", false, "If true, build e2e_node_test.tar.gz and exit.")
 var gubernator = flag.Bool("gubernator", false, "If true, output Gubernator link to view logs")
 var ginkgoFlags = flag.String("ginkgo-flags", "", "Passed to ginkgo to specify additional flags such as --skip=.")
+var resultsJSONFile = flag.String("results-json", "", "If set, write a JSON summary of all test results to this path.")
 var (
 	arc Archive
 )
@@ -69,11 +71,19 @@ func RunRemoteTestSuite(testSuite TestSuite) {
 	// being killed.
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt)
+	// Runners that provision cloud resources register themselves here, so the
+	// handler can release those resources before exiting.
+	cleaners := make(chan InterruptCleaner, 1)
 	go func() {
 		<-c
 		fmt.Printf("Received SIGINT. Will exit on next SIGINT.\n")
 		<-c
 		fmt.Printf("Received another SIGINT. Will exit.\n")
+		select {
+		case cleaner := <-cleaners:
+			cleaner.CleanupOnInterrupt()
+		default:
+		}
 		os.Exit(1)
 	}()
 
@@ -123,6 +133,10 @@ func RunRemoteTestSuite(testSuite TestSuite) {
 		klog.Fatalf("validating remote config, %s", err)
 	}
 
+	if cleaner, ok := runner.(InterruptCleaner); ok {
+		cleaners <- cleaner
+	}
+
 	// Setup coloring
 	stat, _ := os.Stdout.Stat()
 	useColor := (stat.Mode() & os.ModeCharDevice) != 0
@@ -151,8 +165,10 @@ func RunRemoteTestSuite(testSuite TestSuite) {
 	// Wait for all tests to complete and emit the results
 	errCount := 0
 	exitOk := true
+	var allResults []*TestResult
 	for i := 0; i < running; i++ {
 		tr := <-results
+		allResults = append(allResults, tr)
 		host := tr.Host
 		fmt.Println() // Print an empty line
 		fmt.Printf("%s>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>%s\n", blue, noColour)
@@ -160,7 +176,9 @@ func RunRemoteTestSuite(testSuite TestSuite) {
 		fmt.Printf("%s>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>%s\n", blue, noColour)
 		fmt.Printf("Start Test Suite on Host %s\n", host)
 		fmt.Printf("%s\n", tr.Output)
-		if tr.Err != nil {
+		if tr.Skipped {
+			fmt.Printf("Skipped Test Suite on Host %s.\n", host)
+		} else if tr.Err != nil {
 			errCount++
 			fmt.Printf("Failure Finished Test Suite on Host %s. Refer to artifacts directory for ginkgo log for this host.\n%v\n", host, tr.Err)
 		} else {
@@ -172,6 +190,9 @@ func RunRemoteTestSuite(testSuite TestSuite) {
 		fmt.Printf("%s<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<%s\n", blue, noColour)
 		fmt.Println() // Print an empty line
 	}
+	if err := writeResultsJSON(*resultsJSONFile, allResults); err != nil {
+		klog.Errorf("Failed to write results JSON to %q: %v", *resultsJSONFile, err)
+	}
 	// Set the exit code if there were failures
 	if !exitOk {
 		fmt.Printf("Failure: %d errors encountered.\n", errCount)
@@ -182,6 +203,53 @@ func RunRemoteTestSuite(testSuite TestSuite) {
 	callGubernator(*gubernator)
 }
 
+// resultSummary is the JSON-serializable form of a TestResult.
+type resultSummary struct {
+	Image  string `json:"image"`
+	Host   string `json:"host"`
+	ExitOK bool   `json:"exit_ok"`
+	// Skipped reports that no tests ran, e.g. in dry-run mode.
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Duration is the test duration in seconds, including provisioning.
+	Duration float64 `json:"duration"`
+	// BootTime is the boot time of the instance in seconds, if measured.
+	BootTime  float64 `json:"boot_time,omitempty"`
+	JunitPath string  `json:"junit_path,omitempty"`
+	// ResourceUsage is the node resource usage sampled during the test, if any.
+	ResourceUsage string `json:"resource_usage,omitempty"`
+}
+
+// writeResultsJSON writes a machine-readable summary of the collected test
+// results to path, so that dashboards don't have to scrape our stdout.
+func writeResultsJSON(path string, results []*TestResult) error {
+	if path == "" {
+		return nil
+	}
+	summaries := make([]resultSummary, 0, len(results))
+	for _, tr := range results {
+		summary := resultSummary{
+			Image:         tr.Image,
+			Host:          tr.Host,
+			ExitOK:        tr.ExitOK,
+			Skipped:       tr.Skipped,
+			Duration:      tr.Duration.Seconds(),
+			BootTime:      tr.BootTime.Seconds(),
+			JunitPath:     tr.JunitPath,
+			ResourceUsage: tr.ResourceUsage,
+		}
+		if tr.Err != nil {
+			summary.Error = tr.Err.Error()
+		}
+		summaries = append(summaries, summary)
+	}
+	data, err := json.MarshalIndent(summaries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
 func splitCommaList(s string) []string {
 	if len(s) == 0 {
 		return nil
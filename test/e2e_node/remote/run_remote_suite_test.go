@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteResultsJSON(t *testing.T) {
+	resultsPath := filepath.Join(t.TempDir(), "results.json")
+	results := []*TestResult{
+		{
+			Image:     "cos-stable",
+			Host:      "tmp-node-e2e-abcd1234-cos-stable",
+			ExitOK:    true,
+			Duration:  90 * time.Second,
+			JunitPath: "/tmp/junit_cos-stable.xml",
+		},
+		{
+			Image:  "ubuntu",
+			Host:   "tmp-node-e2e-abcd1234-ubuntu",
+			ExitOK: false,
+			Err:    errors.New("test failure"),
+		},
+	}
+
+	if err := writeResultsJSON(resultsPath, results); err != nil {
+		t.Fatalf("failed to write results JSON: %v", err)
+	}
+
+	data, err := os.ReadFile(resultsPath)
+	if err != nil {
+		t.Fatalf("failed to read results JSON: %v", err)
+	}
+	var summaries []resultSummary
+	if err := json.Unmarshal(data, &summaries); err != nil {
+		t.Fatalf("failed to parse results JSON: %v", err)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("expected 2 summaries, got %d", len(summaries))
+	}
+	if summaries[0].Image != "cos-stable" || !summaries[0].ExitOK || summaries[0].Duration != 90 || summaries[0].JunitPath != "/tmp/junit_cos-stable.xml" {
+		t.Errorf("unexpected first summary: %+v", summaries[0])
+	}
+	if summaries[1].Error != "test failure" || summaries[1].ExitOK {
+		t.Errorf("unexpected second summary: %+v", summaries[1])
+	}
+}
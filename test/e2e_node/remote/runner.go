@@ -16,11 +16,31 @@ limitations under the License.
 
 package remote
 
+import "time"
+
 type Runner interface {
 	Validate() error
 	StartTests(suite TestSuite, archivePath string, results chan *TestResult) (numTests int)
 }
 
+// HostLister is an optional capability of a Runner: runners that provision
+// instances can report which hosts are currently alive, e.g. for wrappers
+// printing live instances or driving custom cleanup.
+type HostLister interface {
+	// ActiveHosts returns the names of the hosts currently provisioned by
+	// this runner, in sorted order.
+	ActiveHosts() []string
+}
+
+// InterruptCleaner is an optional capability of a Runner: runners that
+// provision cloud resources implement it so the suite-level signal handler
+// can release them before the process exits on the second SIGINT.
+type InterruptCleaner interface {
+	// CleanupOnInterrupt aborts in-flight provisioning and best-effort
+	// releases the resources the runner holds.
+	CleanupOnInterrupt()
+}
+
 type Config struct {
 	InstanceNamePrefix string
 	ImageConfigFile    string
@@ -42,4 +62,21 @@ type TestResult struct {
 	Err    error
 	Host   string
 	ExitOK bool
+	// Skipped reports that no tests ran for this entry, e.g. in dry-run mode.
+	Skipped bool
+	// GCSResultsPath is the gs:// path logs and junit files for this host
+	// were uploaded to, if any.
+	GCSResultsPath string
+	// Image is the image the test ran on, if the runner provisions images.
+	Image string
+	// Duration is how long the test took, including provisioning.
+	Duration time.Duration
+	// BootTime is how long the instance took from insert completion to SSH
+	// readiness, if measured.
+	BootTime time.Duration
+	// JunitPath is the local path to the junit file for this host, if any.
+	JunitPath string
+	// ResourceUsage is a brief summary of node-level resource usage sampled
+	// during the test, if any.
+	ResourceUsage string
 }
@@ -75,6 +75,19 @@ var sshKeyOverrides = struct {
 	m map[string]string
 }{m: make(map[string]string)}
 
+var sshUserOverrides = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// AddSSHUser overrides the ssh user for the given host, e.g. for images that
+// provision a user differing from the --ssh-user/environment default.
+func AddSSHUser(hostname, user string) {
+	sshUserOverrides.Lock()
+	defer sshUserOverrides.Unlock()
+	sshUserOverrides.m[hostname] = user
+}
+
 // AddSSHKey adds a <hosrtname,path to SSH private key> pair into the sshKeyOverrides map
 func AddSSHKey(hostname, keyFilePath string) {
 	sshKeyOverrides.Lock()
@@ -103,7 +116,12 @@ func GetHostnameOrIP(hostname string) string {
 		host = ip
 	}
 
-	sshUser := GetSSHUser()
+	sshUserOverrides.RLock()
+	sshUser, found := sshUserOverrides.m[hostname]
+	sshUserOverrides.RUnlock()
+	if !found {
+		sshUser = GetSSHUser()
+	}
 	if sshUser != "" {
 		host = fmt.Sprintf("%s@%s", sshUser, host)
 	}
@@ -127,6 +145,16 @@ func SSHNoSudo(host string, cmd ...string) (string, error) {
 	return runSSHCommand(host, "ssh", append([]string{GetHostnameOrIP(host), "--"}, cmd...)...)
 }
 
+// CopyFileToHost copies a local file to the given path on the host via scp.
+func CopyFileToHost(host, localPath, remotePath string) (string, error) {
+	return runSSHCommand(host, "scp", localPath, fmt.Sprintf("%s:%s", GetHostnameOrIP(host), remotePath))
+}
+
+// CopyFileFromHost copies a file from the host to the given local path via scp.
+func CopyFileFromHost(host, remotePath, localPath string) (string, error) {
+	return runSSHCommand(host, "scp", fmt.Sprintf("%s:%s", GetHostnameOrIP(host), remotePath), localPath)
+}
+
 // runSSHCommand executes the ssh or scp command, adding the flag provided --ssh-options
 func runSSHCommand(host, cmd string, args ...string) (string, error) {
 	if key, err := getPrivateSSHKey(host); len(key) != 0 {
@@ -152,6 +180,13 @@ func runSSHCommand(host, cmd string, args ...string) (string, error) {
 	return string(output), nil
 }
 
+// GetPrivateSSHKey returns the path to the ssh private key that will be used
+// for the given host, checking that the key exists. Runners can use this as a
+// preflight check before provisioning instances.
+func GetPrivateSSHKey(host string) (string, error) {
+	return getPrivateSSHKey(host)
+}
+
 // getPrivateSSHKey returns the path to ssh private key
 func getPrivateSSHKey(host string) (string, error) {
 	if *sshKey != "" {
@@ -0,0 +1,41 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remote
+
+import "testing"
+
+func TestGetHostnameOrIPUserOverride(t *testing.T) {
+	oldUser := *sshUser
+	defer func() { *sshUser = oldUser }()
+	*sshUser = "ubuntu"
+
+	AddHostnameIP("user-override-host", "1.2.3.4")
+	if got := GetHostnameOrIP("user-override-host"); got != "ubuntu@1.2.3.4" {
+		t.Errorf("expected the default ssh user to be applied, got %q", got)
+	}
+
+	AddSSHUser("user-override-host", "core")
+	if got := GetHostnameOrIP("user-override-host"); got != "core@1.2.3.4" {
+		t.Errorf("expected the per-host ssh user to take precedence, got %q", got)
+	}
+
+	// Hosts without an override keep the default user.
+	AddHostnameIP("plain-host", "5.6.7.8")
+	if got := GetHostnameOrIP("plain-host"); got != "ubuntu@5.6.7.8" {
+		t.Errorf("expected the default ssh user for hosts without an override, got %q", got)
+	}
+}